@@ -13,7 +13,7 @@ func Put(ctx context.Context, key *Key, src interface{}) (*Key, error) {
 	}
 
 	dsKey := ConvertKeyToDsKey(ctx, key)
-	k, err := datastore.Put(ctx, dsKey, src)
+	k, err := datastore.Put(ctx, dsKey, newEntity(ctx, src))
 	return ConvertDsKeyToKey(k), err
 }
 
@@ -23,16 +23,59 @@ func Get(ctx context.Context, key *Key, dst interface{}) error {
 	}
 
 	dsKey := ConvertKeyToDsKey(ctx, key)
-	return datastore.Get(ctx, dsKey, dst)
+	return datastore.Get(ctx, dsKey, newEntity(ctx, dst))
+}
+
+// GetMulti is a batch version of Get. dst must be a slice of the same length
+// as keys; per-key failures such as ErrNoSuchEntity are reported as an
+// appengine.MultiError.
+func GetMulti(ctx context.Context, keys []*Key, dst interface{}) error {
+	if mock, ok := isMock(ctx); ok {
+		return mock.getMulti(ctx, keys, dst)
+	}
+
+	dsKeys := make([]*datastore.Key, len(keys))
+	for i := range dsKeys {
+		dsKeys[i] = ConvertKeyToDsKey(ctx, keys[i])
+	}
+	return datastore.GetMulti(ctx, dsKeys, newEntities(ctx, dst))
+}
+
+func Delete(ctx context.Context, key *Key) error {
+	if mock, ok := isMock(ctx); ok {
+		return mock.delete(ctx, key)
+	}
+
+	dsKey := ConvertKeyToDsKey(ctx, key)
+	return datastore.Delete(ctx, dsKey)
+}
+
+// DeleteMulti is a batch version of Delete. Under a mock context every key
+// consumes its own MockDelete expectation and the failures are reported as an
+// appengine.MultiError.
+func DeleteMulti(ctx context.Context, keys []*Key) error {
+	if mock, ok := isMock(ctx); ok {
+		return mock.deleteMulti(ctx, keys)
+	}
+
+	dsKeys := make([]*datastore.Key, len(keys))
+	for i := range dsKeys {
+		dsKeys[i] = ConvertKeyToDsKey(ctx, keys[i])
+	}
+	return datastore.DeleteMulti(ctx, dsKeys)
 }
 
 func PutMulti(ctx context.Context, keys []*Key, src interface{}) ([]*Key, error) {
+	if mock, ok := isMock(ctx); ok {
+		return mock.putMulti(ctx, keys, src)
+	}
+
 	dsKeys := make([]*datastore.Key, len(keys))
 	for i := range dsKeys {
 		dsKeys[i] = ConvertKeyToDsKey(ctx, keys[i])
 	}
 
-	dsKeys, err := datastore.PutMulti(ctx, dsKeys, src)
+	dsKeys, err := datastore.PutMulti(ctx, dsKeys, newEntities(ctx, src))
 	if err != nil {
 		return nil, err
 	}
@@ -44,6 +87,10 @@ func PutMulti(ctx context.Context, keys []*Key, src interface{}) ([]*Key, error)
 }
 
 func AllocateIDs(ctx context.Context, kind string, parent *Key, n int) (low, high int64, err error) {
+	if mock, ok := isMock(ctx); ok {
+		return mock.allocateIDs(ctx, kind, parent, n)
+	}
+
 	var parentds *datastore.Key
 	if parent != nil {
 		parentds = ConvertKeyToDsKey(ctx, parent)
@@ -6,6 +6,7 @@ import (
 	"github.com/ahmadmuzakki/gae/internal"
 	gaemock "github.com/ahmadmuzakki/gae/mock"
 	"golang.org/x/net/context"
+	"google.golang.org/appengine"
 	"log"
 	"reflect"
 )
@@ -18,7 +19,10 @@ type DatastoreMock struct {
 type MockAction struct {
 	namespace string
 	action    string
+	kind      string
+	n         int
 	key       *Key
+	keys      []*Key
 	param     interface{}
 	expect    expectation
 }
@@ -34,7 +38,7 @@ func (k *MockKey) String() string {
 }
 
 func (k *MockKey) Encode() string {
-	return k.String()
+	return encodeKey((*Key)(k))
 }
 
 func NewMock(ctx context.Context) (context.Context, *DatastoreMock) {
@@ -65,6 +69,22 @@ func (dm *DatastoreMock) ExpectKey(ctx context.Context, kind string, stringID st
 	return k
 }
 
+// ExpectKeyFromPath expects every key of a NewKeyFromPath or ParseKeyPath
+// call and returns the last one, or nil for a malformed path.
+func (dm *DatastoreMock) ExpectKeyFromPath(ctx context.Context, path ...interface{}) *Key {
+	elements, err := toPathElements(path)
+	if err != nil {
+		log.Printf("[ERROR] %s \n", err)
+		return nil
+	}
+
+	var k *Key
+	for _, e := range elements {
+		k = dm.ExpectKey(ctx, e.kind, e.stringID, e.intID, k)
+	}
+	return k
+}
+
 func (dm *DatastoreMock) newKey(ctx context.Context, kind string, stringID string, intID int64, parent *Key) *Key {
 	if len(dm.keys) == 0 {
 		return nil
@@ -102,36 +122,43 @@ func (dm *DatastoreMock) newKey(ctx context.Context, kind string, stringID strin
 
 type expectation struct {
 	key   *Key
+	keys  []*Key
+	low   int64
+	high  int64
 	err   error
 	value interface{}
 }
 
 const (
-	ActionPut = "Put"
-	ActionGet = "Get"
+	ActionPut      = "Put"
+	ActionPutMulti = "PutMulti"
+	ActionGet      = "Get"
+	ActionGetMulti = "GetMulti"
+	ActionDelete   = "Delete"
+
+	ActionAllocateIDs = "AllocateIDs"
 )
 
 func (dm *DatastoreMock) put(ctx context.Context, key *Key, src interface{}) (*Key, error) {
-	if err := dm.checkExpectations(); err != nil {
+	mock, err := dm.nextMock(ctx, ActionPut, key)
+	if err != nil {
 		return nil, err
 	}
 
-	mock := dm.mocks[0]
-	defer dm.trimMock()
-
-	if err := mock.checkAction(ActionPut); err != nil {
+	if err := mock.checkValue(ctx, src); err != nil {
 		return nil, err
 	}
 
-	if err := mock.checkKey(key); err != nil {
-		return nil, err
-	}
+	return mock.expect.key, mock.expect.err
+}
 
-	if err := mock.checkNamespace(ctx); err != nil {
+func (dm *DatastoreMock) putMulti(ctx context.Context, keys []*Key, src interface{}) ([]*Key, error) {
+	mock, err := dm.nextMock(ctx, ActionPutMulti, nil)
+	if err != nil {
 		return nil, err
 	}
 
-	if err := shouldRunInTransaction(ctx); err != nil {
+	if err := mock.checkKeys(keys); err != nil {
 		return nil, err
 	}
 
@@ -139,55 +166,172 @@ func (dm *DatastoreMock) put(ctx context.Context, key *Key, src interface{}) (*K
 		return nil, err
 	}
 
-	return mock.expect.key, mock.expect.err
+	// the caller reads the MultiError by the index of its keys
+	if errs, ok := mock.expect.err.(appengine.MultiError); ok && len(errs) != len(keys) {
+		return nil, fmt.Errorf("Expected errors %d doesn't match with the %d keys", len(errs), len(keys))
+	}
+
+	return mock.expect.keys, mock.expect.err
 }
 
 func (dm *DatastoreMock) get(ctx context.Context, key *Key, dst interface{}) error {
-	if err := dm.checkExpectations(); err != nil {
+	mock, err := dm.nextMock(ctx, ActionGet, key)
+	if err != nil {
 		return err
 	}
 
-	mock := dm.mocks[0]
-	defer dm.trimMock()
-
-	if err := mock.checkAction(ActionGet); err != nil {
-		return err
+	// only check the param since dst is empty struct
+	typeDest := reflect.TypeOf(dst)
+	typeParam := reflect.TypeOf(mock.param)
+	if !reflect.DeepEqual(typeDest, typeParam) {
+		return fmt.Errorf("Destination %+v doesn't match with %+v", typeDest, typeParam)
 	}
 
-	if err := mock.checkKey(key); err != nil {
-		return err
-	}
+	// assign value from *mock.param to *dst
+	// direct the pointer first
+	valDst := reflect.ValueOf(dst)
+	directDst := reflect.Indirect(valDst)
 
-	if err := mock.checkNamespace(ctx); err != nil {
+	valParam := reflect.ValueOf(mock.param)
+	directParam := reflect.Indirect(valParam)
+
+	// set the pointer with the payload from *mock.param
+	directDst.Set(directParam)
+
+	return nil
+}
+
+func (dm *DatastoreMock) getMulti(ctx context.Context, keys []*Key, dst interface{}) error {
+	mock, err := dm.nextMock(ctx, ActionGetMulti, nil)
+	if err != nil {
 		return err
 	}
 
-	if err := shouldRunInTransaction(ctx); err != nil {
+	if err := mock.checkKeys(keys); err != nil {
 		return err
 	}
 
-	// only check the param since dst is empty struct
 	typeDest := reflect.TypeOf(dst)
 	typeParam := reflect.TypeOf(mock.param)
 	if !reflect.DeepEqual(typeDest, typeParam) {
 		return fmt.Errorf("Destination %+v doesn't match with %+v", typeDest, typeParam)
 	}
 
-	// assign value from *mock.param to *dst
-	// direct the pointer first
 	valDst := reflect.ValueOf(dst)
-	directDst := reflect.Indirect(valDst)
+	if valDst.Kind() != reflect.Slice {
+		return fmt.Errorf("Destination should be slice but got %+v", typeDest)
+	}
 
 	valParam := reflect.ValueOf(mock.param)
-	directParam := reflect.Indirect(valParam)
+	if valDst.Len() != len(keys) || valParam.Len() != len(keys) {
+		return fmt.Errorf("Destination length %d and expected values length %d should match the %d keys",
+			valDst.Len(), valParam.Len(), len(keys))
+	}
 
-	// set the pointer with the payload from *mock.param
-	directDst.Set(directParam)
+	// a plain error fails the whole call, a MultiError only fails its own index
+	errs, isMulti := mock.expect.err.(appengine.MultiError)
+	if mock.expect.err != nil && !isMulti {
+		return mock.expect.err
+	}
+	if isMulti && len(errs) != len(keys) {
+		return fmt.Errorf("Expected errors %d doesn't match with the %d keys", len(errs), len(keys))
+	}
 
-	dm.trimMock()
+	for i := range keys {
+		if isMulti && errs[i] != nil {
+			continue
+		}
+
+		row := valDst.Index(i)
+		value := valParam.Index(i)
+		// a nil expected value leaves the row as is
+		if value.Kind() == reflect.Ptr && value.IsNil() {
+			continue
+		}
+		if row.Kind() == reflect.Ptr && !row.IsNil() {
+			row.Elem().Set(value.Elem())
+		} else {
+			row.Set(value)
+		}
+	}
+
+	return mock.expect.err
+}
+
+func (dm *DatastoreMock) delete(ctx context.Context, key *Key) error {
+	mock, err := dm.nextMock(ctx, ActionDelete, key)
+	if err != nil {
+		return err
+	}
+
+	return mock.expect.err
+}
+
+func (dm *DatastoreMock) allocateIDs(ctx context.Context, kind string, parent *Key, n int) (int64, int64, error) {
+	// the parent is validated as the key of the action
+	mock, err := dm.nextMock(ctx, ActionAllocateIDs, parent)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if mock.kind != kind {
+		return 0, 0, fmt.Errorf("Kind %s doesn't match with %s", kind, mock.kind)
+	}
+
+	if mock.n != n {
+		return 0, 0, fmt.Errorf("Allocating %d IDs doesn't match with expected %d", n, mock.n)
+	}
+
+	return mock.expect.low, mock.expect.high, mock.expect.err
+}
+
+func (dm *DatastoreMock) deleteMulti(ctx context.Context, keys []*Key) error {
+	var (
+		errs   = make(appengine.MultiError, len(keys))
+		failed bool
+	)
+	for i, key := range keys {
+		if err := dm.delete(ctx, key); err != nil {
+			errs[i] = err
+			failed = true
+		}
+	}
+
+	if failed {
+		return errs
+	}
 	return nil
 }
 
+// nextMock pops the next expectation and validates the action, key,
+// namespace and transaction against it.
+func (dm *DatastoreMock) nextMock(ctx context.Context, action string, key *Key) (*MockAction, error) {
+	if err := dm.checkExpectations(); err != nil {
+		return nil, err
+	}
+
+	mock := dm.mocks[0]
+	dm.trimMock()
+
+	if err := mock.checkAction(action); err != nil {
+		return nil, err
+	}
+
+	if err := mock.checkKey(key); err != nil {
+		return nil, err
+	}
+
+	if err := mock.checkNamespace(ctx); err != nil {
+		return nil, err
+	}
+
+	if err := shouldRunInTransaction(ctx); err != nil {
+		return nil, err
+	}
+
+	return mock, nil
+}
+
 func (dm *DatastoreMock) checkExpectations() error {
 	if len(dm.mocks) == 0 {
 		return errors.New("No more expectation")
@@ -216,6 +360,13 @@ func (mock *MockAction) checkKey(key *Key) error {
 	return nil
 }
 
+func (mock *MockAction) checkKeys(keys []*Key) error {
+	if !reflect.DeepEqual(mock.keys, keys) {
+		return fmt.Errorf("Keys %+v doesn't match with %+v", mock.keys, keys)
+	}
+	return nil
+}
+
 func (dm *DatastoreMock) MockPut(key *Key, src interface{}) *MockAction {
 	m := &MockAction{
 		action: ActionPut,
@@ -226,6 +377,16 @@ func (dm *DatastoreMock) MockPut(key *Key, src interface{}) *MockAction {
 	return m
 }
 
+func (dm *DatastoreMock) MockPutMulti(keys []*Key, src interface{}) *MockAction {
+	m := &MockAction{
+		action: ActionPutMulti,
+		param:  src,
+		keys:   keys,
+	}
+	dm.appendMock(m)
+	return m
+}
+
 func (dm *DatastoreMock) MockGet(key *Key, dst interface{}) *MockAction {
 	m := &MockAction{
 		action: ActionGet,
@@ -236,6 +397,42 @@ func (dm *DatastoreMock) MockGet(key *Key, dst interface{}) *MockAction {
 	return m
 }
 
+// MockGetMulti expects a GetMulti call with keys. values is a slice of the
+// same type as the destination and is copied into it index by index, except
+// for the indexes failed by WillReturnMultiErr.
+func (dm *DatastoreMock) MockGetMulti(keys []*Key, values interface{}) *MockAction {
+	m := &MockAction{
+		action: ActionGetMulti,
+		param:  values,
+		keys:   keys,
+	}
+	dm.appendMock(m)
+	return m
+}
+
+func (dm *DatastoreMock) MockDelete(key *Key) *MockAction {
+	m := &MockAction{
+		action: ActionDelete,
+		key:    key,
+	}
+	dm.appendMock(m)
+	return m
+}
+
+// MockAllocateIDs expects an AllocateIDs call for n IDs of kind under parent.
+// Keys built afterwards from the returned range are matched against ExpectKey
+// like any other key.
+func (dm *DatastoreMock) MockAllocateIDs(kind string, parent *Key, n int) *MockAction {
+	m := &MockAction{
+		action: ActionAllocateIDs,
+		kind:   kind,
+		n:      n,
+		key:    parent,
+	}
+	dm.appendMock(m)
+	return m
+}
+
 func (dm *DatastoreMock) appendMock(m *MockAction) {
 	if dm.mocks == nil {
 		dm.mocks = make([]*MockAction, 0)
@@ -263,6 +460,34 @@ func (m *MockAction) WillReturnKeyErr(key *Key, err error) *MockAction {
 	return m
 }
 
+func (m *MockAction) WillReturnKeysErr(keys []*Key, err error) *MockAction {
+	m.expect.keys = keys
+	m.expect.err = err
+	return m
+}
+
+// WillReturnMultiErr scripts a per-index error for the multi actions, e.g.
+// WillReturnMultiErr(nil, ErrNoSuchEntity) fails only the second key. There
+// is one error for every key. When none is set the action succeeds, like the
+// SDK which returns a nil error.
+func (m *MockAction) WillReturnMultiErr(errs ...error) *MockAction {
+	m.expect.err = nil
+	for _, err := range errs {
+		if err != nil {
+			m.expect.err = appengine.MultiError(errs)
+			break
+		}
+	}
+	return m
+}
+
+func (m *MockAction) WillReturnRange(low, high int64, err error) *MockAction {
+	m.expect.low = low
+	m.expect.high = high
+	m.expect.err = err
+	return m
+}
+
 func (m *MockAction) ExpectValue(val interface{}) *MockAction {
 	m.expect.value = val
 	return m
@@ -0,0 +1,99 @@
+package datastore
+
+import (
+	gaemock "github.com/ahmadmuzakki/gae/mock"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"testing"
+)
+
+type mockUser struct {
+	Name string
+}
+
+func newGetMultiMock() (context.Context, *DatastoreMock, []*Key) {
+	ctx, dm := NewMock(gaemock.NewMock())
+	keys := []*Key{
+		dm.ExpectKey(ctx, "User", "a", 0, nil),
+		dm.ExpectKey(ctx, "User", "b", 0, nil),
+		dm.ExpectKey(ctx, "User", "c", 0, nil),
+	}
+	return ctx, dm, keys
+}
+
+func TestGetMultiShortMultiError(t *testing.T) {
+	ctx, dm, keys := newGetMultiMock()
+	dm.MockGetMulti(keys, []*mockUser{{"a"}, {"b"}, {"c"}}).WillReturnMultiErr(nil, ErrNoSuchEntity)
+
+	dst := []*mockUser{{}, {}, {}}
+	err := GetMulti(ctx, keys, dst)
+	if err == nil {
+		t.Fatal("GetMulti with 2 errors for 3 keys should fail")
+	}
+	if _, ok := err.(appengine.MultiError); ok {
+		t.Fatalf("GetMulti returned the scripted MultiError %v", err)
+	}
+}
+
+func TestGetMultiNilValue(t *testing.T) {
+	ctx, dm, keys := newGetMultiMock()
+	dm.MockGetMulti(keys, []*mockUser{{"a"}, nil, {"c"}})
+
+	dst := []*mockUser{{}, {Name: "kept"}, {}}
+	if err := GetMulti(ctx, keys, dst); err != nil {
+		t.Fatal(err)
+	}
+	if dst[0].Name != "a" || dst[1].Name != "kept" || dst[2].Name != "c" {
+		t.Fatalf("GetMulti loaded %v, %v, %v", dst[0], dst[1], dst[2])
+	}
+}
+
+func TestGetMultiMultiErr(t *testing.T) {
+	ctx, dm, keys := newGetMultiMock()
+	dm.MockGetMulti(keys, []*mockUser{{"a"}, {"b"}, {"c"}}).WillReturnMultiErr(nil, ErrNoSuchEntity, nil)
+
+	dst := []*mockUser{{}, {}, {}}
+	err := GetMulti(ctx, keys, dst)
+	errs, ok := err.(appengine.MultiError)
+	if !ok || errs[1] != ErrNoSuchEntity {
+		t.Fatalf("GetMulti returned %v", err)
+	}
+	if dst[0].Name != "a" || dst[1].Name != "" || dst[2].Name != "c" {
+		t.Fatalf("GetMulti loaded %v, %v, %v", dst[0], dst[1], dst[2])
+	}
+}
+
+func TestWillReturnMultiErrAllNil(t *testing.T) {
+	ctx, dm, keys := newGetMultiMock()
+	dm.MockGetMulti(keys, []*mockUser{{"a"}, {"b"}, {"c"}}).WillReturnMultiErr(nil, nil, nil)
+
+	dst := []*mockUser{{}, {}, {}}
+	if err := GetMulti(ctx, keys, dst); err != nil {
+		t.Fatalf("GetMulti returned %v, want nil", err)
+	}
+}
+
+func TestPutMultiShortMultiError(t *testing.T) {
+	ctx, dm, keys := newGetMultiMock()
+	src := []*mockUser{{"a"}, {"b"}, {"c"}}
+	dm.MockPutMulti(keys, src).WillReturnMultiErr(nil, ErrNoSuchEntity)
+
+	_, err := PutMulti(ctx, keys, src)
+	if err == nil {
+		t.Fatal("PutMulti with 2 errors for 3 keys should fail")
+	}
+	if _, ok := err.(appengine.MultiError); ok {
+		t.Fatalf("PutMulti returned the scripted MultiError %v", err)
+	}
+}
+
+func TestPutMultiMultiErr(t *testing.T) {
+	ctx, dm, keys := newGetMultiMock()
+	src := []*mockUser{{"a"}, {"b"}, {"c"}}
+	dm.MockPutMulti(keys, src).WillReturnMultiErr(nil, ErrNoSuchEntity, nil)
+
+	_, err := PutMulti(ctx, keys, src)
+	if errs, ok := err.(appengine.MultiError); !ok || len(errs) != len(keys) || errs[1] != ErrNoSuchEntity {
+		t.Fatalf("PutMulti returned %v", err)
+	}
+}
@@ -0,0 +1,356 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// The SDK only knows how to save its own *datastore.Key, so a struct holding
+// our *Key is saved through a shadow struct built with reflect.StructOf. The
+// shadow has the same properties as the original struct with every wrapper
+// key or TypedKey (or slice of them) replaced by the SDK key, and it is
+// converted back once the SDK has loaded it.
+
+var (
+	typeOfKey   = reflect.TypeOf((*Key)(nil))
+	typeOfDsKey = reflect.TypeOf((*datastore.Key)(nil))
+	typeOfPLS   = reflect.TypeOf((*datastore.PropertyLoadSaver)(nil)).Elem()
+
+	typeOfTypedKey = reflect.TypeOf((*typedKey)(nil)).Elem()
+)
+
+// typedKey is implemented by every TypedKey, which is saved like its *Key.
+type typedKey interface {
+	untyped() *Key
+}
+
+// typedKeySetter is implemented by a pointer to a TypedKey.
+type typedKeySetter interface {
+	setUntyped(key *Key)
+}
+
+type shadow struct {
+	typ reflect.Type
+	// fields is the index path of every shadow struct field in the original
+	// struct. Fields promoted from an embedded struct have a longer path.
+	fields [][]int
+}
+
+var (
+	shadowsMutex sync.Mutex
+	shadows      = make(map[reflect.Type]*shadow)
+)
+
+// shadowOf returns the shadow of t, or nil when t holds no wrapper key.
+func shadowOf(t reflect.Type) *shadow {
+	shadowsMutex.Lock()
+	defer shadowsMutex.Unlock()
+	return shadowOfLocked(t, make(map[reflect.Type]bool))
+}
+
+func shadowOfLocked(t reflect.Type, visiting map[reflect.Type]bool) *shadow {
+	if s, ok := shadows[t]; ok {
+		return s
+	}
+
+	// recursive structs are rejected by the SDK anyway
+	if visiting[t] {
+		return nil
+	}
+	visiting[t] = true
+	defer delete(visiting, t)
+
+	var s *shadow
+	switch {
+	case t == typeOfKey || (t.Kind() == reflect.Struct && t.Implements(typeOfTypedKey)):
+		s = &shadow{typ: typeOfDsKey}
+	case t.Kind() == reflect.Slice:
+		if elem := shadowOfLocked(t.Elem(), visiting); elem != nil {
+			s = &shadow{typ: reflect.SliceOf(elem.typ)}
+		}
+	case t.Kind() == reflect.Struct && !reflect.PtrTo(t).Implements(typeOfPLS):
+		s = &shadow{}
+		var fields []reflect.StructField
+		if s.addFields(t, nil, nil, &fields, visiting) {
+			s.typ = reflect.StructOf(fields)
+		} else {
+			s = nil
+		}
+	}
+
+	shadows[t] = s
+	return s
+}
+
+// addFields appends the shadow fields of struct t, found at index in the
+// original struct, and reports whether any of them holds a wrapper key.
+func (s *shadow) addFields(t reflect.Type, index []int, opts []string, fields *[]reflect.StructField, visiting map[reflect.Type]bool) bool {
+	changed := false
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		// skip unexported fields like the SDK does, except for the anonymous
+		// ones whose fields are promoted
+		if f.PkgPath != "" && !f.Anonymous {
+			continue
+		}
+
+		tags := strings.Split(f.Tag.Get("datastore"), ",")
+		name := tags[0]
+		if name == "-" {
+			continue
+		}
+		fieldOpts := append(append([]string(nil), opts...), tags[1:]...)
+		fieldIndex := append(append([]int(nil), index...), i)
+
+		// the shadow cannot embed, so the promoted fields are flattened into it
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			if s.addFields(f.Type, fieldIndex, fieldOpts, fields, visiting) {
+				changed = true
+			}
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		typ := f.Type
+		if sub := shadowOfLocked(f.Type, visiting); sub != nil {
+			typ = sub.typ
+			changed = true
+		}
+
+		// the property name moves to the tag so the Go field name can be
+		// anything unique
+		tag := strings.Join(append([]string{name}, fieldOpts...), ",")
+		*fields = append(*fields, reflect.StructField{
+			Name: fmt.Sprintf("F%d", len(*fields)),
+			Type: typ,
+			Tag:  reflect.StructTag(fmt.Sprintf(`datastore:"%s"`, tag)),
+		})
+		s.fields = append(s.fields, fieldIndex)
+	}
+	return changed
+}
+
+// toShadow converts v into its shadow value, turning wrapper keys into SDK keys.
+func toShadow(ctx context.Context, v reflect.Value) reflect.Value {
+	s := shadowOf(v.Type())
+	if s == nil {
+		return v
+	}
+
+	if tk, ok := v.Interface().(typedKey); ok && v.Kind() == reflect.Struct {
+		return reflect.ValueOf(ConvertKeyToDsKey(ctx, tk.untyped()))
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		return reflect.ValueOf(ConvertKeyToDsKey(ctx, v.Interface().(*Key)))
+	case reflect.Slice:
+		if v.IsNil() {
+			return reflect.Zero(s.typ)
+		}
+		sv := reflect.MakeSlice(s.typ, v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			sv.Index(i).Set(toShadow(ctx, v.Index(i)))
+		}
+		return sv
+	case reflect.Struct:
+		sv := reflect.New(s.typ).Elem()
+		for i, index := range s.fields {
+			sv.Field(i).Set(toShadow(ctx, v.FieldByIndex(index)))
+		}
+		return sv
+	}
+	return v
+}
+
+// fromShadow sets dst from its shadow value, turning SDK keys back into
+// wrapper keys.
+func fromShadow(dst reflect.Value, sv reflect.Value) {
+	s := shadowOf(dst.Type())
+	if s == nil {
+		dst.Set(sv)
+		return
+	}
+
+	if dst.Kind() == reflect.Struct && dst.Type().Implements(typeOfTypedKey) {
+		dst.Addr().Interface().(typedKeySetter).setUntyped(ConvertDsKeyToKey(sv.Interface().(*datastore.Key)))
+		return
+	}
+
+	switch dst.Kind() {
+	case reflect.Ptr:
+		dst.Set(reflect.ValueOf(ConvertDsKeyToKey(sv.Interface().(*datastore.Key))))
+	case reflect.Slice:
+		if sv.IsNil() {
+			dst.Set(reflect.Zero(dst.Type()))
+			return
+		}
+		v := reflect.MakeSlice(dst.Type(), sv.Len(), sv.Len())
+		for i := 0; i < sv.Len(); i++ {
+			fromShadow(v.Index(i), sv.Index(i))
+		}
+		dst.Set(v)
+	case reflect.Struct:
+		for i, index := range s.fields {
+			fromShadow(dst.FieldByIndex(index), sv.Field(i))
+		}
+	}
+}
+
+// entity is the PropertyLoadSaver handed to the SDK in place of a struct
+// holding wrapper keys.
+type entity struct {
+	ctx    context.Context
+	shadow *shadow
+	// v is either the struct itself or a settable *S element of a []*S
+	v reflect.Value
+}
+
+func (e *entity) Save() ([]datastore.Property, error) {
+	v := e.v
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil, errors.New("datastore: nil entity")
+		}
+		v = v.Elem()
+	}
+
+	sv := reflect.New(e.shadow.typ)
+	sv.Elem().Set(toShadow(e.ctx, v))
+	return datastore.SaveStruct(sv.Interface())
+}
+
+func (e *entity) Load(props []datastore.Property) error {
+	v := e.v
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+
+	// start from the current value, the SDK leaves missing properties as is
+	sv := reflect.New(e.shadow.typ)
+	sv.Elem().Set(toShadow(e.ctx, v))
+
+	err := datastore.LoadStruct(sv.Interface(), props)
+	mismatch, ok := err.(*datastore.ErrFieldMismatch)
+	if err != nil && !ok {
+		return err
+	}
+
+	fromShadow(v, sv.Elem())
+	if mismatch != nil {
+		// report the caller's struct rather than the shadow
+		return &datastore.ErrFieldMismatch{
+			StructType: v.Type(),
+			FieldName:  mismatch.FieldName,
+			Reason:     mismatch.Reason,
+		}
+	}
+	return nil
+}
+
+// newEntity wraps a struct pointer for the SDK when it holds wrapper keys,
+// anything else is returned untouched.
+func newEntity(ctx context.Context, src interface{}) interface{} {
+	v := reflect.ValueOf(src)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return src
+	}
+
+	s := shadowOf(v.Elem().Type())
+	if s == nil {
+		return src
+	}
+	return &entity{ctx: ctx, shadow: s, v: v.Elem()}
+}
+
+// newEntities is the batch version of newEntity for []S and []*S.
+func newEntities(ctx context.Context, src interface{}) interface{} {
+	v := reflect.ValueOf(src)
+	if v.Kind() != reflect.Slice {
+		return src
+	}
+
+	elemType := v.Type().Elem()
+	if elemType.Kind() == reflect.Ptr {
+		elemType = elemType.Elem()
+	}
+	if elemType.Kind() != reflect.Struct {
+		return src
+	}
+
+	s := shadowOf(elemType)
+	if s == nil {
+		return src
+	}
+
+	entities := make([]datastore.PropertyLoadSaver, v.Len())
+	for i := range entities {
+		entities[i] = &entity{ctx: ctx, shadow: s, v: v.Index(i)}
+	}
+	return entities
+}
+
+// getAll runs q.GetAll, going through property lists when the elements of
+// dst hold wrapper keys.
+func getAll(ctx context.Context, q *datastore.Query, dst interface{}) ([]*datastore.Key, error) {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Slice {
+		return q.GetAll(ctx, dst)
+	}
+
+	sliceDst := v.Elem()
+	elemType := sliceDst.Type().Elem()
+	isPtr := elemType.Kind() == reflect.Ptr
+	if isPtr {
+		elemType = elemType.Elem()
+	}
+	if elemType.Kind() != reflect.Struct {
+		return q.GetAll(ctx, dst)
+	}
+
+	s := shadowOf(elemType)
+	if s == nil {
+		return q.GetAll(ctx, dst)
+	}
+
+	var props []datastore.PropertyList
+	keys, err := q.GetAll(ctx, &props)
+
+	var errFieldMismatch error
+	for _, p := range props {
+		row := reflect.New(elemType)
+		e := &entity{ctx: ctx, shadow: s, v: row.Elem()}
+		if err := e.Load(p); err != nil {
+			if _, ok := err.(*datastore.ErrFieldMismatch); !ok {
+				return keys, err
+			}
+			if errFieldMismatch == nil {
+				errFieldMismatch = err
+			}
+		}
+
+		if isPtr {
+			sliceDst.Set(reflect.Append(sliceDst, row))
+		} else {
+			sliceDst.Set(reflect.Append(sliceDst, row.Elem()))
+		}
+	}
+
+	if err != nil {
+		return keys, err
+	}
+	return keys, errFieldMismatch
+}
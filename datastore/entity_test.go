@@ -0,0 +1,32 @@
+package datastore
+
+import (
+	"google.golang.org/appengine/datastore"
+	"reflect"
+	"testing"
+)
+
+type entityOwner struct {
+	Owner *Key
+	Name  string
+}
+
+func TestEntityLoadFieldMismatch(t *testing.T) {
+	props := []datastore.Property{
+		{Name: "Name", Value: "a"},
+		{Name: "Missing", Value: int64(1)},
+	}
+
+	var dst entityOwner
+	err := newEntity(nil, &dst).(*entity).Load(props)
+	mismatch, ok := err.(*datastore.ErrFieldMismatch)
+	if !ok {
+		t.Fatalf("Load returned %v, want an ErrFieldMismatch", err)
+	}
+	if mismatch.StructType != reflect.TypeOf(dst) {
+		t.Errorf("ErrFieldMismatch.StructType is %v, want %v", mismatch.StructType, reflect.TypeOf(dst))
+	}
+	if dst.Name != "a" {
+		t.Errorf("Load set Name to %q, want %q", dst.Name, "a")
+	}
+}
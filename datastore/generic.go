@@ -0,0 +1,54 @@
+//go:build go1.18
+
+package datastore
+
+import (
+	"golang.org/x/net/context"
+	"reflect"
+)
+
+// GetAs loads the entity stored for key into a new T, a struct or a pointer
+// to one. key is a *Key or a TypedKey[T]. Typed keys are keys of a struct
+// type, so GetAs[*S] only takes a *Key, which TypedKey[S].Key returns. Like
+// Get, a field mismatch still returns the loaded entity along with the error.
+func GetAs[T any, K interface{ *Key | TypedKey[T] }](ctx context.Context, key K) (T, error) {
+	row, dst := newRow[T]()
+	err := Get(ctx, untypedKey[T](key), dst)
+	return *row, err
+}
+
+// GetMultiAs is a batch version of GetAs. Per-key failures are reported as
+// an appengine.MultiError, the entities of the other keys are loaded.
+func GetMultiAs[T any, K interface{ *Key | TypedKey[T] }](ctx context.Context, keys []K) ([]T, error) {
+	untyped := make([]*Key, len(keys))
+	for i, k := range keys {
+		untyped[i] = untypedKey[T](k)
+	}
+
+	dst := make([]T, len(keys))
+	for i := range dst {
+		row, _ := newRow[T]()
+		dst[i] = *row
+	}
+	err := GetMulti(ctx, untyped, dst)
+	return dst, err
+}
+
+// GetAllAs runs q and returns its entities as a []T along with their keys.
+// A keys-only query returns no entities.
+func GetAllAs[T any](ctx context.Context, q *Query) ([]T, []*Key, error) {
+	var dst []T
+	keys, err := q.GetAll(ctx, &dst)
+	return dst, keys, err
+}
+
+// newRow returns a new T to load an entity into and the destination to pass
+// for it. When T is a *S the row points to a new S, which is the destination.
+func newRow[T any]() (*T, interface{}) {
+	row := new(T)
+	if t := reflect.TypeOf(*row); t != nil && t.Kind() == reflect.Ptr {
+		*row = reflect.New(t.Elem()).Interface().(T)
+		return row, *row
+	}
+	return row, row
+}
@@ -0,0 +1,816 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseGQL parses a GQL query into a Query. It supports
+//
+//	SELECT [DISTINCT] * | __key__ | property, ...
+//	[FROM kind]
+//	[WHERE condition [AND condition ...]]
+//	[ORDER BY property [ASC | DESC], ...]
+//	[LIMIT count] [OFFSET count]
+//
+// where a condition is one of
+//
+//	property {= | < | <= | > | >= | !=} value
+//	property IN (value, ...) or ARRAY(value, ...)
+//	ANCESTOR IS key or __key__ HAS ANCESTOR key
+//
+// A value is a string, number, TRUE, FALSE, NULL, DATETIME('RFC 3339 time'),
+// KEY([NAMESPACE('ns'),] kind, ID, ...) or a bound parameter @1, @2, ...
+// taken from args. KEY creates its key with NewKeyFromPath, so under a mock
+// context it consumes an ExpectKey expectation. Every argument has to be
+// used.
+func ParseGQL(ctx context.Context, gql string, args ...interface{}) (*Query, error) {
+	tokens, err := lexGQL(gql)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &gqlParser{
+		ctx:    ctx,
+		tokens: tokens,
+		args:   args,
+		used:   make([]bool, len(args)),
+	}
+	q, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, used := range p.used {
+		if !used {
+			return nil, fmt.Errorf("datastore: GQL argument @%d is not used", i+1)
+		}
+	}
+	if q.err != nil {
+		return nil, q.err
+	}
+	return q, nil
+}
+
+type gqlTokenType int
+
+const (
+	gqlEOF gqlTokenType = iota
+	gqlIdent
+	// gqlQuotedIdent is a `backquoted` name, which is never a keyword
+	gqlQuotedIdent
+	gqlString
+	gqlInt
+	gqlFloat
+	gqlParam
+	gqlSymbol
+)
+
+type gqlToken struct {
+	typ  gqlTokenType
+	text string
+	pos  int
+}
+
+func lexGQL(s string) ([]gqlToken, error) {
+	var tokens []gqlToken
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+
+		case isGQLIdentStart(c):
+			j := i + 1
+			for j < len(s) && isGQLIdentPart(s[j]) {
+				j++
+			}
+			tokens = append(tokens, gqlToken{typ: gqlIdent, text: s[i:j], pos: i})
+			i = j
+
+		case c == '`' || c == '\'' || c == '"':
+			text, n, err := lexGQLQuoted(s[i:])
+			if err != nil {
+				return nil, fmt.Errorf("datastore: GQL: %v at offset %d", err, i)
+			}
+			typ := gqlString
+			if c == '`' {
+				typ = gqlQuotedIdent
+			}
+			tokens = append(tokens, gqlToken{typ: typ, text: text, pos: i})
+			i += n
+
+		case isGQLDigit(c) || ((c == '-' || c == '.') && i+1 < len(s) && isGQLDigit(s[i+1])):
+			j, typ := lexGQLNumber(s, i)
+			tokens = append(tokens, gqlToken{typ: typ, text: s[i:j], pos: i})
+			i = j
+
+		case c == '@':
+			j := i + 1
+			for j < len(s) && isGQLIdentPart(s[j]) {
+				j++
+			}
+			if j == i+1 {
+				return nil, fmt.Errorf("datastore: GQL: missing parameter name at offset %d", i)
+			}
+			tokens = append(tokens, gqlToken{typ: gqlParam, text: s[i+1 : j], pos: i})
+			i = j
+
+		case strings.HasPrefix(s[i:], "<=") || strings.HasPrefix(s[i:], ">=") || strings.HasPrefix(s[i:], "!="):
+			tokens = append(tokens, gqlToken{typ: gqlSymbol, text: s[i : i+2], pos: i})
+			i += 2
+
+		case strings.IndexByte("=<>(),*", c) >= 0:
+			tokens = append(tokens, gqlToken{typ: gqlSymbol, text: s[i : i+1], pos: i})
+			i++
+
+		default:
+			return nil, fmt.Errorf("datastore: GQL: unexpected %q at offset %d", c, i)
+		}
+	}
+	return append(tokens, gqlToken{typ: gqlEOF, pos: len(s)}), nil
+}
+
+// lexGQLNumber returns the end of the number starting at s[i] and whether it
+// is an integer or a float.
+func lexGQLNumber(s string, i int) (int, gqlTokenType) {
+	typ := gqlInt
+	j := i + 1
+	if s[i] == '.' {
+		typ = gqlFloat
+	}
+	for ; j < len(s); j++ {
+		switch c := s[j]; {
+		case isGQLDigit(c):
+		case c == '.':
+			typ = gqlFloat
+		case (c == 'e' || c == 'E') && j+1 < len(s):
+			typ = gqlFloat
+			if s[j+1] == '+' || s[j+1] == '-' {
+				j++
+			}
+		default:
+			return j, typ
+		}
+	}
+	return j, typ
+}
+
+// lexGQLQuoted reads the quoted string or name at the start of s and returns
+// its value and length. The quote is escaped by a backslash or by doubling it.
+func lexGQLQuoted(s string) (string, int, error) {
+	quote := s[0]
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s):
+			i++
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case '0':
+				b.WriteByte(0)
+			default:
+				b.WriteByte(s[i])
+			}
+		case c == quote && i+1 < len(s) && s[i+1] == quote:
+			b.WriteByte(quote)
+			i++
+		case c == quote:
+			return b.String(), i + 1, nil
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, errors.New("unterminated quoted string")
+}
+
+func isGQLDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isGQLIdentStart(c byte) bool {
+	return c == '_' || c == '$' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || c >= 0x80
+}
+
+func isGQLIdentPart(c byte) bool {
+	return isGQLIdentStart(c) || isGQLDigit(c) || c == '.'
+}
+
+type gqlParser struct {
+	ctx    context.Context
+	tokens []gqlToken
+	pos    int
+
+	args []interface{}
+	// used records which of args were bound
+	used []bool
+}
+
+func (p *gqlParser) peek() gqlToken {
+	return p.tokens[p.pos]
+}
+
+func (p *gqlParser) next() gqlToken {
+	t := p.tokens[p.pos]
+	if t.typ != gqlEOF {
+		p.pos++
+	}
+	return t
+}
+
+// keyword consumes the given keywords if they are next, ignoring case.
+func (p *gqlParser) keyword(words ...string) bool {
+	for i, w := range words {
+		if p.pos+i >= len(p.tokens) {
+			return false
+		}
+		t := p.tokens[p.pos+i]
+		if t.typ != gqlIdent || !strings.EqualFold(t.text, w) {
+			return false
+		}
+	}
+	p.pos += len(words)
+	return true
+}
+
+// symbol consumes s if it is next.
+func (p *gqlParser) symbol(s string) bool {
+	if t := p.peek(); t.typ == gqlSymbol && t.text == s {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *gqlParser) expect(s string) error {
+	if !p.symbol(s) {
+		return p.errorf("expected %q", s)
+	}
+	return nil
+}
+
+func (p *gqlParser) errorf(format string, args ...interface{}) error {
+	t := p.peek()
+	found := "end of query"
+	if t.typ != gqlEOF {
+		found = strconv.Quote(t.text)
+	}
+	return fmt.Errorf("datastore: GQL: %s, found %s at offset %d", fmt.Sprintf(format, args...), found, t.pos)
+}
+
+func (p *gqlParser) name() (string, error) {
+	t := p.peek()
+	if t.typ != gqlIdent && t.typ != gqlQuotedIdent {
+		return "", p.errorf("expected a name")
+	}
+	p.pos++
+	return t.text, nil
+}
+
+func (p *gqlParser) parse() (*Query, error) {
+	if !p.keyword("SELECT") {
+		return nil, p.errorf("expected SELECT")
+	}
+
+	distinct := p.keyword("DISTINCT")
+	keysOnly := false
+	var projection []string
+	switch {
+	case p.symbol("*"):
+	case p.keyword("__key__"):
+		keysOnly = true
+	default:
+		for {
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			projection = append(projection, name)
+			if !p.symbol(",") {
+				break
+			}
+		}
+	}
+	if distinct && len(projection) == 0 {
+		return nil, errors.New("datastore: GQL: DISTINCT needs a projection")
+	}
+
+	var kind string
+	if p.keyword("FROM") {
+		var err error
+		if kind, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+
+	q := NewQuery(p.ctx, kind)
+	if len(projection) > 0 {
+		q = q.Project(projection...)
+	}
+	if distinct {
+		q = q.Distinct()
+	}
+	if keysOnly {
+		q = q.KeysOnly()
+	}
+
+	if p.keyword("WHERE") {
+		for {
+			var err error
+			if q, err = p.condition(q); err != nil {
+				return nil, err
+			}
+			if !p.keyword("AND") {
+				break
+			}
+		}
+	}
+
+	if p.keyword("ORDER", "BY") {
+		for {
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if p.keyword("DESC") {
+				name = "-" + name
+			} else {
+				p.keyword("ASC")
+			}
+			q = q.Order(name)
+			if !p.symbol(",") {
+				break
+			}
+		}
+	}
+
+	if p.keyword("LIMIT") {
+		n, err := p.count()
+		if err != nil {
+			return nil, err
+		}
+		q = q.Limit(n)
+	}
+	if p.keyword("OFFSET") {
+		n, err := p.count()
+		if err != nil {
+			return nil, err
+		}
+		q = q.Offset(n)
+	}
+
+	if p.peek().typ != gqlEOF {
+		return nil, p.errorf("unexpected clause")
+	}
+	return q, nil
+}
+
+func (p *gqlParser) condition(q *Query) (*Query, error) {
+	if p.keyword("ANCESTOR", "IS") {
+		return p.ancestor(q)
+	}
+
+	field, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.keyword("HAS", "ANCESTOR") {
+		if field != "__key__" {
+			return nil, fmt.Errorf("datastore: GQL: HAS ANCESTOR applies to __key__, not %s", field)
+		}
+		return p.ancestor(q)
+	}
+
+	if p.keyword("IN") {
+		values, err := p.list()
+		if err != nil {
+			return nil, err
+		}
+		return q.FilterIn(field, values...), nil
+	}
+
+	op := p.peek()
+	if op.typ != gqlSymbol || !isGQLOperator(op.text) {
+		return nil, p.errorf("expected an operator after %s", field)
+	}
+	p.pos++
+
+	value, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	return q.Filter(field+" "+op.text, value), nil
+}
+
+func isGQLOperator(s string) bool {
+	switch s {
+	case "=", "<", "<=", ">", ">=", "!=":
+		return true
+	}
+	return false
+}
+
+func (p *gqlParser) ancestor(q *Query) (*Query, error) {
+	if q.ancestor != nil {
+		return nil, p.errorf("the ancestor is already set")
+	}
+
+	value, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	key, ok := value.(*Key)
+	if !ok || key == nil {
+		return nil, fmt.Errorf("datastore: GQL: the ancestor should be a key, not %T", value)
+	}
+	return q.Ancestor(key), nil
+}
+
+// list reads the values of an IN condition: a parenthesized list, an ARRAY
+// or a parameter bound to a slice.
+func (p *gqlParser) list() ([]interface{}, error) {
+	if t := p.peek(); t.typ == gqlParam {
+		p.pos++
+		arg, err := p.arg(t)
+		if err != nil {
+			return nil, err
+		}
+
+		v := reflect.ValueOf(arg)
+		if v.Kind() != reflect.Slice || v.Type().Elem().Kind() == reflect.Uint8 {
+			return nil, fmt.Errorf("datastore: GQL: argument @%s of IN should be a slice, not %T", t.text, arg)
+		}
+		values := make([]interface{}, v.Len())
+		for i := range values {
+			values[i] = v.Index(i).Interface()
+		}
+		return values, nil
+	}
+
+	p.keyword("ARRAY")
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	var values []interface{}
+	for {
+		value, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+		if !p.symbol(",") {
+			break
+		}
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+func (p *gqlParser) value() (interface{}, error) {
+	t := p.peek()
+	switch t.typ {
+	case gqlString:
+		p.pos++
+		return t.text, nil
+	case gqlInt:
+		p.pos++
+		n, err := strconv.ParseInt(t.text, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("datastore: GQL: invalid integer %s at offset %d", t.text, t.pos)
+		}
+		return n, nil
+	case gqlFloat:
+		p.pos++
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("datastore: GQL: invalid number %s at offset %d", t.text, t.pos)
+		}
+		return f, nil
+	case gqlParam:
+		p.pos++
+		return p.arg(t)
+	}
+
+	switch {
+	case p.keyword("TRUE"):
+		return true, nil
+	case p.keyword("FALSE"):
+		return false, nil
+	case p.keyword("NULL"):
+		return nil, nil
+	case p.keyword("KEY"):
+		return p.key()
+	case p.keyword("DATETIME"):
+		return p.datetime()
+	}
+	return nil, p.errorf("expected a value")
+}
+
+// key reads the alternating kinds and IDs of KEY(...), which may start with
+// the NAMESPACE('ns') of the key. A kind can be written as a name or as a
+// string.
+func (p *gqlParser) key() (*Key, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+
+	ctx := p.ctx
+	// a kind named NAMESPACE is followed by its ID, not by (
+	if t := p.peek(); t.typ == gqlIdent && strings.EqualFold(t.text, "NAMESPACE") &&
+		p.tokens[p.pos+1].typ == gqlSymbol && p.tokens[p.pos+1].text == "(" {
+		p.pos += 2
+		ns := p.next()
+		if ns.typ != gqlString {
+			return nil, fmt.Errorf("datastore: GQL: NAMESPACE takes a string at offset %d", ns.pos)
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+
+		var err error
+		if ctx, err = appengine.Namespace(ctx, ns.text); err != nil {
+			return nil, err
+		}
+	}
+
+	var path []interface{}
+	for {
+		if t := p.peek(); len(path)%2 == 0 && (t.typ == gqlIdent || t.typ == gqlQuotedIdent) {
+			p.pos++
+			path = append(path, t.text)
+		} else {
+			value, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			path = append(path, value)
+		}
+		if !p.symbol(",") {
+			break
+		}
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+
+	return NewKeyFromPath(ctx, path...)
+}
+
+func (p *gqlParser) datetime() (time.Time, error) {
+	if err := p.expect("("); err != nil {
+		return time.Time{}, err
+	}
+	t := p.next()
+	if t.typ != gqlString {
+		return time.Time{}, fmt.Errorf("datastore: GQL: DATETIME takes a string at offset %d", t.pos)
+	}
+	if err := p.expect(")"); err != nil {
+		return time.Time{}, err
+	}
+
+	v, err := time.Parse(time.RFC3339Nano, t.text)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("datastore: GQL: invalid DATETIME %q: %v", t.text, err)
+	}
+	return v, nil
+}
+
+// count reads the number of LIMIT or OFFSET, which can't be negative.
+func (p *gqlParser) count() (int, error) {
+	t := p.next()
+	var n int
+	switch t.typ {
+	case gqlInt:
+		var err error
+		if n, err = strconv.Atoi(t.text); err != nil {
+			return 0, fmt.Errorf("datastore: GQL: invalid count %s at offset %d", t.text, t.pos)
+		}
+	case gqlParam:
+		arg, err := p.arg(t)
+		if err != nil {
+			return 0, err
+		}
+		switch v := reflect.ValueOf(arg); v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			n = int(v.Int())
+		default:
+			return 0, fmt.Errorf("datastore: GQL: argument @%s should be an integer, not %T", t.text, arg)
+		}
+	default:
+		return 0, fmt.Errorf("datastore: GQL: expected a count at offset %d", t.pos)
+	}
+
+	if n < 0 {
+		return 0, fmt.Errorf("datastore: GQL: negative count %d at offset %d", n, t.pos)
+	}
+	return n, nil
+}
+
+// arg returns the argument bound to the parameter t, numbered from 1.
+func (p *gqlParser) arg(t gqlToken) (interface{}, error) {
+	n, err := strconv.Atoi(t.text)
+	if err != nil {
+		return nil, fmt.Errorf("datastore: GQL: named parameter @%s is not supported", t.text)
+	}
+	if n < 1 || n > len(p.args) {
+		return nil, fmt.Errorf("datastore: GQL: no argument for @%d", n)
+	}
+	p.used[n-1] = true
+	return p.args[n-1], nil
+}
+
+// gqlKeywords are written in backquotes when they are used as names, so they
+// are not read as keywords.
+var gqlKeywords = map[string]bool{
+	"SELECT": true, "DISTINCT": true, "FROM": true, "WHERE": true, "AND": true, "OR": true,
+	"ORDER": true, "BY": true, "ASC": true, "DESC": true, "LIMIT": true, "OFFSET": true,
+	"ANCESTOR": true, "IS": true, "HAS": true, "IN": true, "ARRAY": true, "KEY": true,
+	"DATETIME": true, "TRUE": true, "FALSE": true, "NULL": true, "START": true, "END": true,
+}
+
+// String returns the GQL of the query.
+func (q *Query) String() string {
+	return q.GQL()
+}
+
+// GQL renders the query as GQL in a canonical form, which ParseGQL reads
+// back unless the query has OR filters or cursors: GQL can only bind
+// cursors, so they are written after the offset as START 'cursor' and
+// END 'cursor'. Filters keep the order in which they were added.
+func (q *Query) GQL() string {
+	var b strings.Builder
+	b.WriteString("SELECT ")
+	switch {
+	case len(q.projection) > 0:
+		if q.distinct {
+			b.WriteString("DISTINCT ")
+		}
+		names := make([]string, len(q.projection))
+		for i, p := range q.projection {
+			names[i] = gqlName(p)
+		}
+		b.WriteString(strings.Join(names, ", "))
+	case q.keysOnly:
+		b.WriteString("__key__")
+	default:
+		b.WriteString("*")
+	}
+
+	if q.kind != "" {
+		b.WriteString(" FROM " + gqlName(q.kind))
+	}
+
+	var conditions []string
+	if q.ancestor != nil {
+		conditions = append(conditions, "ANCESTOR IS "+gqlValue(q.ancestor))
+	}
+	if len(q.or) > 0 {
+		alternatives := make([]string, len(q.or))
+		for i, sub := range q.or {
+			alternatives[i] = strings.Join(sub.gqlConditions(), " AND ")
+			if len(sub.filter) > 1 || len(sub.or) > 0 {
+				alternatives[i] = "(" + alternatives[i] + ")"
+			}
+		}
+		conditions = append(conditions, "("+strings.Join(alternatives, " OR ")+")")
+	}
+	conditions = append(conditions, q.gqlConditions()...)
+	if len(conditions) > 0 {
+		b.WriteString(" WHERE " + strings.Join(conditions, " AND "))
+	}
+
+	if len(q.order) > 0 {
+		orders := make([]string, len(q.order))
+		for i, o := range q.order {
+			if strings.HasPrefix(o, "-") {
+				orders[i] = gqlName(strings.TrimSpace(o[1:])) + " DESC"
+			} else {
+				orders[i] = gqlName(o)
+			}
+		}
+		b.WriteString(" ORDER BY " + strings.Join(orders, ", "))
+	}
+
+	if q.limit >= 0 {
+		b.WriteString(" LIMIT " + strconv.Itoa(int(q.limit)))
+	}
+	if q.offset > 0 {
+		b.WriteString(" OFFSET " + strconv.Itoa(int(q.offset)))
+	}
+	if s := q.start.String(); s != "" {
+		b.WriteString(" START " + gqlQuote(s))
+	}
+	if s := q.end.String(); s != "" {
+		b.WriteString(" END " + gqlQuote(s))
+	}
+	return b.String()
+}
+
+// gqlConditions renders the filters of q, without its OR.
+func (q *Query) gqlConditions() []string {
+	conditions := make([]string, len(q.filter))
+	for i, f := range q.filter {
+		if f.Op == in {
+			values := f.Value.([]interface{})
+			rendered := make([]string, len(values))
+			for j, v := range values {
+				rendered[j] = gqlValue(v)
+			}
+			conditions[i] = gqlName(f.Field) + " IN (" + strings.Join(rendered, ", ") + ")"
+			continue
+		}
+		conditions[i] = gqlName(f.Field) + " " + f.Op.String() + " " + gqlValue(f.Value)
+	}
+	return conditions
+}
+
+func gqlName(name string) string {
+	plain := name != "" && isGQLIdentStart(name[0]) && !gqlKeywords[strings.ToUpper(name)]
+	for i := 1; plain && i < len(name); i++ {
+		plain = isGQLIdentPart(name[i])
+	}
+	if plain {
+		return name
+	}
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+func gqlQuote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `'`, `\'`, "\n", `\n`, "\r", `\r`, "\t", `\t`, "\x00", `\0`)
+	return "'" + r.Replace(s) + "'"
+}
+
+func gqlValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case *Key:
+		if v == nil {
+			return "NULL"
+		}
+		var path []string
+		for k := v; k != nil; k = k.parent {
+			id := strconv.FormatInt(k.intID, 10)
+			if k.stringID != "" {
+				id = gqlQuote(k.stringID)
+			}
+			path = append([]string{gqlName(k.kind), id}, path...)
+		}
+		if v.namespace != "" {
+			path = append([]string{"NAMESPACE(" + gqlQuote(v.namespace) + ")"}, path...)
+		}
+		return "KEY(" + strings.Join(path, ", ") + ")"
+	case *datastore.Key:
+		if v == nil {
+			return "NULL"
+		}
+		return gqlValue(ConvertDsKeyToKey(v))
+	case typedKey:
+		return gqlValue(v.untyped())
+	case time.Time:
+		return "DATETIME(" + gqlQuote(v.Format(time.RFC3339Nano)) + ")"
+	case []byte:
+		return gqlQuote(string(v))
+	}
+
+	switch rv := reflect.ValueOf(v); rv.Kind() {
+	case reflect.String:
+		return gqlQuote(rv.String())
+	case reflect.Bool:
+		if rv.Bool() {
+			return "TRUE"
+		}
+		return "FALSE"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(rv.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(rv.Uint(), 10)
+	case reflect.Float32, reflect.Float64:
+		s := strconv.FormatFloat(rv.Float(), 'g', -1, 64)
+		// keep it a float when it is read back
+		if !strings.ContainsAny(s, ".eIN") {
+			s += ".0"
+		}
+		return s
+	}
+	return gqlQuote(fmt.Sprint(v))
+}
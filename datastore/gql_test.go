@@ -0,0 +1,125 @@
+package datastore
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGQLRoundTrip(t *testing.T) {
+	// NewKey takes the appID from GAE_APPLICATION out of App Engine
+	t.Setenv("GAE_APPLICATION", "s~test-app")
+	ctx := context.Background()
+
+	ancestor, err := NewKeyFromPath(ctx, "Org", "ac'me", "Team", 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner, err := NewKeyFromPath(ctx, "User", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nsCtx, err := appengine.Namespace(ctx, "tenant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenant, err := NewKeyFromPath(nsCtx, "Org", "acme", "NAMESPACE", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []*Query{
+		NewQuery(ctx, "User"),
+		NewQuery(ctx, "User").KeysOnly(),
+		NewQuery(ctx, "User").Project("Name", "from", "first name").Distinct(),
+		NewQuery(ctx, "User").Ancestor(ancestor).Filter("Owner =", owner),
+		NewQuery(ctx, "User").Ancestor(tenant),
+		NewQuery(ctx, "User").
+			Filter("Name =", "it's\n\\").
+			Filter("Age >=", int64(-3)).
+			FilterNotEqual("Age", 1.5).
+			FilterIn("Tag", "a", int64(2), true, nil).
+			Filter("Born =", time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)).
+			Filter("Score =", float64(150)),
+		NewQuery(ctx, "User").Order("-Age").Order("Name").Order("__key__").Limit(10).Offset(3),
+		NewQuery(ctx, "User").Limit(0),
+		NewQuery(ctx, ""),
+	}
+
+	for _, q := range tests {
+		gql := q.GQL()
+		back, err := ParseGQL(ctx, gql)
+		if err != nil {
+			t.Errorf("ParseGQL(%s): %v", gql, err)
+			continue
+		}
+		if !reflect.DeepEqual(back, q) {
+			t.Errorf("ParseGQL(%s) = %s, which is another query", gql, back.GQL())
+		}
+		if back.GQL() != gql {
+			t.Errorf("ParseGQL(%s) renders as %s", gql, back.GQL())
+		}
+	}
+}
+
+func TestParseGQLArguments(t *testing.T) {
+	q, err := ParseGQL(nil, "select * from User where Name = @1 and Tag in @2 limit @3 offset @3", "alice", []string{"a", "b"}, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := NewQuery(nil, "User").Filter("Name =", "alice").FilterIn("Tag", "a", "b").Limit(5).Offset(5)
+	if !reflect.DeepEqual(q, want) {
+		t.Errorf("ParseGQL = %s, want %s", q.GQL(), want.GQL())
+	}
+}
+
+func TestParseGQLErrors(t *testing.T) {
+	tests := []struct {
+		gql  string
+		args []interface{}
+		err  string
+	}{
+		{"", nil, "expected SELECT"},
+		{"SELECT * FROM", nil, "expected a name"},
+		{"SELECT * FROM User WHERE", nil, "expected a name"},
+		{"SELECT * FROM User WHERE Age", nil, "expected an operator"},
+		{"SELECT * FROM User WHERE Age = 'x", nil, "unterminated"},
+		{"SELECT DISTINCT * FROM User", nil, "DISTINCT needs a projection"},
+		{"SELECT * FROM User WHERE Age < 1 AND Height > 2", nil, "inequality filters on multiple properties"},
+		{"SELECT * FROM User WHERE ANCESTOR IS 3", nil, "should be a key"},
+		{"SELECT * FROM User LIMIT -1", nil, "negative count"},
+		{"SELECT * FROM User OFFSET -2", nil, "negative count"},
+		{"SELECT * FROM User LIMIT @1", []interface{}{-1}, "negative count"},
+		{"SELECT * FROM User LIMIT x", nil, "expected a count"},
+		{"SELECT * FROM User WHERE Age = @2", []interface{}{1}, "no argument for @2"},
+		{"SELECT * FROM User", []interface{}{1}, "@1 is not used"},
+		{"SELECT * FROM User WHERE Tag IN @1", []interface{}{"a"}, "should be a slice"},
+		{"SELECT * FROM User junk", nil, "unexpected clause"},
+	}
+
+	for _, test := range tests {
+		_, err := ParseGQL(nil, test.gql, test.args...)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("ParseGQL(%q) = %v, want an error containing %q", test.gql, err, test.err)
+		}
+	}
+}
+
+func TestGQLKeyNamespace(t *testing.T) {
+	org := &Key{kind: "Org", stringID: "acme", appID: "app"}
+	tenant := &Key{kind: "Org", stringID: "acme", appID: "app", namespace: "tenant"}
+
+	gql := NewQuery(nil, "User").Ancestor(tenant).GQL()
+	want := "SELECT * FROM User WHERE ANCESTOR IS KEY(NAMESPACE('tenant'), Org, 'acme')"
+	if gql != want {
+		t.Errorf("GQL = %s, want %s", gql, want)
+	}
+
+	err := matchQuery(NewQuery(nil, "User").Ancestor(org), NewQuery(nil, "User").Ancestor(tenant))
+	if err == nil || !strings.Contains(err.Error(), "NAMESPACE('tenant')") || strings.Contains(err.Error(), "types of their values") {
+		t.Errorf("matchQuery of ancestors in different namespaces = %v", err)
+	}
+}
@@ -1,8 +1,11 @@
 package datastore
 
 import (
+	"bytes"
 	"context"
-	"github.com/ahmadmuzakki/gae/internal"
+	"encoding/gob"
+	"errors"
+	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
 )
 
@@ -22,14 +25,17 @@ func NewKey(ctx context.Context, kind string, stringID string, intID int64, pare
 	}
 
 	k := &Key{
-		kind:      kind,
-		parent:    parent,
-		intID:     intID,
-		stringID:  stringID,
-		namespace: internal.GetNamespace(ctx),
+		kind:     kind,
+		parent:   parent,
+		intID:    intID,
+		stringID: stringID,
 	}
 
-	k.dsKey = ConvertKeyToDsKey(ctx, k)
+	// a new key takes the appID and namespace from the context, or the
+	// namespace of its parent, the same way the SDK does
+	k.dsKey = datastore.NewKey(ctx, kind, stringID, intID, ConvertKeyToDsKey(ctx, parent))
+	k.appID = k.dsKey.AppID()
+	k.namespace = k.dsKey.Namespace()
 	return k
 }
 
@@ -42,7 +48,26 @@ func ConvertKeyToDsKey(ctx context.Context, key *Key) *datastore.Key {
 		return nil
 	}
 
+	if key.dsKey != nil {
+		return key.dsKey
+	}
+
+	// datastore.NewKey can't take an appID, so a key that has its own one,
+	// e.g. a decoded key, is rebuilt from its encoded form
+	if key.appID != "" {
+		if dsKey, err := datastore.DecodeKey(encodeKey(key)); err == nil {
+			return dsKey
+		}
+	}
+
 	parent := ConvertKeyToDsKey(ctx, key.parent)
+	if parent == nil {
+		// datastore.NewKey takes the namespace of the parent, or the one of
+		// the context for a root key
+		if nsCtx, err := appengine.Namespace(ctx, key.namespace); err == nil {
+			ctx = nsCtx
+		}
+	}
 	return datastore.NewKey(ctx, key.kind, key.stringID, key.intID, parent)
 }
 
@@ -58,7 +83,9 @@ func ConvertDsKeyToKey(key *datastore.Key) *Key {
 		parent:    parent,
 		intID:     key.IntID(),
 		stringID:  key.StringID(),
+		appID:     key.AppID(),
 		namespace: key.Namespace(),
+		dsKey:     key,
 	}
 	return k
 }
@@ -81,6 +108,9 @@ func (k *Key) String() string {
 	return k.dsKey.String()
 }
 
+// Encode returns an opaque representation of the key suitable for use in
+// HTML and URLs. Keys without an SDK key, such as mock and converted keys,
+// are encoded offline with their full path, namespace and appID.
 func (k *Key) Encode() string {
 	if k.dsKey == nil {
 		mock := MockKey(*k)
@@ -89,15 +119,203 @@ func (k *Key) Encode() string {
 	return k.dsKey.Encode()
 }
 
+// Kind returns the key's kind (also known as entity type).
+func (k *Key) Kind() string {
+	return k.kind
+}
+
+// StringID returns the key's string ID (also known as an entity name or key
+// name), which may be "".
+func (k *Key) StringID() string {
+	return k.stringID
+}
+
+// IntID returns the key's integer ID, which may be 0.
+func (k *Key) IntID() int64 {
+	return k.intID
+}
+
+// Parent returns the key's parent key, which may be nil.
 func (k *Key) Parent() *Key {
+	if k == nil {
+		return nil
+	}
 	return k.parent
 }
 
-func (k *Key) IntID() int64 {
-	return k.dsKey.IntID()
+// AppID returns the key's application ID. It is empty for mock keys.
+func (k *Key) AppID() string {
+	return k.appID
+}
+
+// Namespace returns the key's namespace.
+func (k *Key) Namespace() string {
+	return k.namespace
+}
+
+// Incomplete returns whether the key does not refer to a stored entity.
+// In particular, whether the key has a zero StringID and a zero IntID.
+func (k *Key) Incomplete() bool {
+	return k.stringID == "" && k.intID == 0
+}
+
+// Equal returns whether two keys are equal.
+func (k *Key) Equal(o *Key) bool {
+	for k != nil && o != nil {
+		if k.kind != o.kind || k.stringID != o.stringID || k.intID != o.intID || k.appID != o.appID || k.namespace != o.namespace {
+			return false
+		}
+		k, o = k.parent, o.parent
+	}
+	return k == o
+}
+
+// Root returns the furthest ancestor of the key, which may be itself.
+func (k *Key) Root() *Key {
+	if k == nil {
+		return nil
+	}
+	for k.parent != nil {
+		k = k.parent
+	}
+	return k
+}
+
+// Ancestors returns the ancestors of the key, from its parent up to the root.
+func (k *Key) Ancestors() []*Key {
+	var ancestors []*Key
+	for p := k.Parent(); p != nil; p = p.parent {
+		ancestors = append(ancestors, p)
+	}
+	return ancestors
+}
+
+// Depth returns the number of keys in the key's path, 1 for a root key.
+func (k *Key) Depth() int {
+	depth := 0
+	for ; k != nil; k = k.parent {
+		depth++
+	}
+	return depth
+}
+
+// IsDescendantOf returns whether other is one of the key's ancestors. A key
+// is not a descendant of itself.
+func (k *Key) IsDescendantOf(other *Key) bool {
+	if other == nil {
+		return false
+	}
+	for _, ancestor := range k.Ancestors() {
+		if ancestor.Equal(other) {
+			return true
+		}
+	}
+	return false
+}
+
+// SameEntityGroup returns whether a and b share the same root key and thus
+// can be written in a single transaction.
+func SameEntityGroup(a, b *Key) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	return a.Root().Equal(b.Root())
+}
+
+type gobKey struct {
+	Kind      string
+	StringID  string
+	IntID     int64
+	Parent    *gobKey
+	AppID     string
+	Namespace string
+}
+
+func keyToGobKey(k *Key) *gobKey {
+	if k == nil {
+		return nil
+	}
+	return &gobKey{
+		Kind:      k.kind,
+		StringID:  k.stringID,
+		IntID:     k.intID,
+		Parent:    keyToGobKey(k.parent),
+		AppID:     k.appID,
+		Namespace: k.namespace,
+	}
+}
+
+func gobKeyToKey(gk *gobKey) *Key {
+	if gk == nil {
+		return nil
+	}
+	return &Key{
+		kind:      gk.Kind,
+		stringID:  gk.StringID,
+		intID:     gk.IntID,
+		parent:    gobKeyToKey(gk.Parent),
+		appID:     gk.AppID,
+		namespace: gk.Namespace,
+	}
+}
+
+func (k *Key) GobEncode() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(keyToGobKey(k)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (k *Key) GobDecode(buf []byte) error {
+	gk := new(gobKey)
+	if err := gob.NewDecoder(bytes.NewBuffer(buf)).Decode(gk); err != nil {
+		return err
+	}
+	*k = *gobKeyToKey(gk)
+	return nil
+}
+
+// MarshalText encodes the key the same way the SDK encodes web-safe keys,
+// without needing an App Engine context.
+func (k *Key) MarshalText() ([]byte, error) {
+	return []byte(encodeKey(k)), nil
+}
+
+func (k *Key) UnmarshalText(buf []byte) error {
+	k2, err := decodeKey(string(buf))
+	if err != nil {
+		return err
+	}
+	*k = *k2
+	return nil
 }
 
+func (k *Key) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + encodeKey(k) + `"`), nil
+}
+
+func (k *Key) UnmarshalJSON(buf []byte) error {
+	// like the other unmarshalers, null leaves the key as is
+	if string(buf) == "null" {
+		return nil
+	}
+	if len(buf) < 2 || buf[0] != '"' || buf[len(buf)-1] != '"' {
+		return errors.New("datastore: bad JSON key")
+	}
+	return k.UnmarshalText(buf[1 : len(buf)-1])
+}
+
+// DecodeKey decodes a key from the opaque representation returned by Encode.
+// It is decoded offline, so it works with mock keys and needs no App Engine
+// context. Keys encoded by cloud.google.com/go/datastore are decoded by the
+// SDK, once datastore.EnableKeyConversion has been called.
 func DecodeKey(encoded string) (*Key, error) {
+	if key, err := decodeKey(encoded); err == nil {
+		return key, nil
+	}
+
+	// keys encoded by cloud.google.com/go/datastore are only known by the SDK
 	dskey, err := datastore.DecodeKey(encoded)
 	if err != nil {
 		return nil, err
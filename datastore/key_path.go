@@ -0,0 +1,176 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// A key path lists the kind and ID of every key from the root down, e.g.
+// Org,acme/User,42. String IDs that would read as a number, and any kind or
+// ID holding a separator or a quote, are written as Go quoted strings.
+
+type pathElement struct {
+	kind     string
+	stringID string
+	intID    int64
+}
+
+// NewKeyFromPath creates a key from alternating kinds and IDs, starting at
+// the root, e.g. NewKeyFromPath(ctx, "Org", "acme", "User", 42). A string ID
+// is a StringID and any integer ID is an IntID; an empty or zero ID makes the
+// last key incomplete. Every key of the path is created with NewKey, so under
+// a mock context each of them consumes an ExpectKey expectation.
+func NewKeyFromPath(ctx context.Context, path ...interface{}) (*Key, error) {
+	elements, err := toPathElements(path)
+	if err != nil {
+		return nil, err
+	}
+	return newKeyFromElements(ctx, elements)
+}
+
+// ParseKeyPath creates the key written by Key.Path in the namespace of ctx.
+func ParseKeyPath(ctx context.Context, path string) (*Key, error) {
+	elements, err := parsePath(path)
+	if err != nil {
+		return nil, err
+	}
+	return newKeyFromElements(ctx, elements)
+}
+
+// Path returns the human-readable path of the key, which ParseKeyPath reads
+// back. It leaves out the namespace and appID.
+func (k *Key) Path() string {
+	if k == nil {
+		return ""
+	}
+
+	var elements []string
+	for i := k; i != nil; i = i.parent {
+		id := strconv.FormatInt(i.intID, 10)
+		if i.stringID != "" {
+			id = quotePathID(i.stringID)
+		}
+		elements = append([]string{quotePathToken(i.kind) + "," + id}, elements...)
+	}
+	return strings.Join(elements, "/")
+}
+
+func newKeyFromElements(ctx context.Context, elements []pathElement) (*Key, error) {
+	var k *Key
+	for i, e := range elements {
+		if i < len(elements)-1 && e.stringID == "" && e.intID == 0 {
+			return nil, fmt.Errorf("datastore: key path has an incomplete ancestor %s", e.kind)
+		}
+
+		k = NewKey(ctx, e.kind, e.stringID, e.intID, k)
+		// the mock gives nil for a key it doesn't expect
+		if k == nil {
+			return nil, fmt.Errorf("datastore: unexpected key %s in path", e.kind)
+		}
+	}
+	return k, nil
+}
+
+func toPathElements(path []interface{}) ([]pathElement, error) {
+	if len(path) == 0 || len(path)%2 != 0 {
+		return nil, errors.New("datastore: key path should alternate kinds and IDs")
+	}
+
+	elements := make([]pathElement, 0, len(path)/2)
+	for i := 0; i < len(path); i += 2 {
+		kind, ok := path[i].(string)
+		if !ok || kind == "" {
+			return nil, fmt.Errorf("datastore: invalid kind %v in key path", path[i])
+		}
+
+		e := pathElement{kind: kind}
+		switch id := reflect.ValueOf(path[i+1]); id.Kind() {
+		case reflect.String:
+			e.stringID = id.String()
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			e.intID = id.Int()
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			if id.Uint() > 1<<63-1 {
+				return nil, fmt.Errorf("datastore: ID %v of kind %s overflows int64", path[i+1], kind)
+			}
+			e.intID = int64(id.Uint())
+		default:
+			return nil, fmt.Errorf("datastore: invalid ID %v of kind %s in key path", path[i+1], kind)
+		}
+		elements = append(elements, e)
+	}
+	return elements, nil
+}
+
+func parsePath(path string) ([]pathElement, error) {
+	// the string form of a key starts with a slash
+	rest := strings.TrimPrefix(strings.TrimSpace(path), "/")
+
+	var elements []pathElement
+	for {
+		kind, _, r, err := nextPathToken(rest, path)
+		if err != nil {
+			return nil, err
+		}
+		if kind == "" || !strings.HasPrefix(r, ",") {
+			return nil, fmt.Errorf("datastore: key path %q should have a kind and an ID in every element", path)
+		}
+
+		id, idQuoted, r, err := nextPathToken(r[1:], path)
+		if err != nil {
+			return nil, err
+		}
+
+		e := pathElement{kind: kind}
+		if n, err := strconv.ParseInt(id, 10, 64); err == nil && !idQuoted {
+			e.intID = n
+		} else {
+			e.stringID = id
+		}
+		elements = append(elements, e)
+
+		if r == "" {
+			return elements, nil
+		}
+		if r[0] != '/' {
+			return nil, fmt.Errorf("datastore: unexpected %q in key path %q", r, path)
+		}
+		rest = r[1:]
+	}
+}
+
+// nextPathToken reads a kind or an ID up to the next separator.
+func nextPathToken(s string, path string) (token string, quoted bool, rest string, err error) {
+	if strings.HasPrefix(s, `"`) {
+		prefix, err := strconv.QuotedPrefix(s)
+		if err != nil {
+			return "", false, "", fmt.Errorf("datastore: bad quoted string in key path %q", path)
+		}
+		token, _ = strconv.Unquote(prefix)
+		return token, true, s[len(prefix):], nil
+	}
+
+	end := strings.IndexAny(s, ",/")
+	if end < 0 {
+		end = len(s)
+	}
+	return s[:end], false, s[end:], nil
+}
+
+func quotePathToken(s string) string {
+	if s == "" || strings.ContainsAny(s, `,/"`) || strings.TrimSpace(s) != s {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func quotePathID(id string) string {
+	if _, err := strconv.ParseInt(id, 10, 64); err == nil {
+		return strconv.Quote(id)
+	}
+	return quotePathToken(id)
+}
@@ -0,0 +1,113 @@
+package datastore
+
+import (
+	gaemock "github.com/ahmadmuzakki/gae/mock"
+	"golang.org/x/net/context"
+	"testing"
+)
+
+func TestKeyPathRoundTrip(t *testing.T) {
+	// NewKey takes the appID from GAE_APPLICATION out of App Engine
+	t.Setenv("GAE_APPLICATION", "s~test-app")
+	ctx := context.Background()
+
+	tests := []struct {
+		key  []interface{}
+		path string
+	}{
+		{[]interface{}{"User", "alice"}, `User,alice`},
+		{[]interface{}{"Org", "acme", "User", 42}, `Org,acme/User,42`},
+		{[]interface{}{"User", -5}, `User,-5`},
+		{[]interface{}{"User", 0}, `User,0`},
+		// a string ID which reads as a number is quoted
+		{[]interface{}{"User", "42"}, `User,"42"`},
+		{[]interface{}{"User", "-5"}, `User,"-5"`},
+		// separators, quotes and surrounding spaces are quoted
+		{[]interface{}{"a,b", "x/y"}, `"a,b","x/y"`},
+		{[]interface{}{"User", `say "hi"`}, `User,"say \"hi\""`},
+		{[]interface{}{" User", "pad "}, `" User","pad "`},
+		{[]interface{}{"User", "a b"}, `User,a b`},
+		{[]interface{}{"User", "été"}, `User,été`},
+	}
+
+	for _, test := range tests {
+		elements, err := toPathElements(test.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var key *Key
+		for _, e := range elements {
+			key = &Key{kind: e.kind, stringID: e.stringID, intID: e.intID, parent: key, appID: "s~test-app"}
+		}
+
+		path := key.Path()
+		if path != test.path {
+			t.Errorf("Path of %v = %s, want %s", test.key, path, test.path)
+		}
+		back, err := ParseKeyPath(ctx, path)
+		if err != nil {
+			t.Errorf("ParseKeyPath(%s): %v", path, err)
+			continue
+		}
+		if !back.Equal(key) {
+			t.Errorf("ParseKeyPath(%s) = %s, want the key of %v", path, back.Path(), test.key)
+		}
+	}
+}
+
+func TestParseKeyPath(t *testing.T) {
+	t.Setenv("GAE_APPLICATION", "s~test-app")
+	ctx := context.Background()
+
+	// the string form of a key and spaces around the path are accepted
+	for _, path := range []string{"/Org,acme/User,42", "  Org,acme/User,42\n"} {
+		k, err := ParseKeyPath(ctx, path)
+		if err != nil {
+			t.Errorf("ParseKeyPath(%q): %v", path, err)
+			continue
+		}
+		if k.Path() != "Org,acme/User,42" {
+			t.Errorf("ParseKeyPath(%q) = %s", path, k.Path())
+		}
+	}
+
+	for _, path := range []string{
+		"",
+		"User",
+		"User,1/",
+		",1",
+		`User,"unterminated`,
+		`User,"a"b`,
+		"Org,0/User,1",
+	} {
+		if k, err := ParseKeyPath(ctx, path); err == nil {
+			t.Errorf("ParseKeyPath(%q) = %s, want an error", path, k.Path())
+		}
+	}
+}
+
+func TestExpectKeyFromPath(t *testing.T) {
+	ctx, dm := NewMock(gaemock.NewMock())
+	want := dm.ExpectKeyFromPath(ctx, "Org", "acme", "User", 42)
+	if want == nil || want.Path() != "Org,acme/User,42" {
+		t.Fatalf("ExpectKeyFromPath = %v", want)
+	}
+	dm.ExpectKeyFromPath(ctx, "Org", "acme", "User", 42)
+
+	// each key is created once from the path, in order from the root
+	k, err := NewKeyFromPath(ctx, "Org", "acme", "User", 42)
+	if err != nil || k != want {
+		t.Errorf("NewKeyFromPath = %v, %v, want %v", k, err, want)
+	}
+	k, err = ParseKeyPath(ctx, want.Path())
+	if err != nil || !k.Equal(want) {
+		t.Errorf("ParseKeyPath = %v, %v, want %v", k, err, want)
+	}
+	if _, err := NewKeyFromPath(ctx, "Org", "acme"); err == nil {
+		t.Error("NewKeyFromPath should fail once the expected keys are used")
+	}
+
+	if k := dm.ExpectKeyFromPath(ctx, "Org"); k != nil {
+		t.Errorf("ExpectKeyFromPath of an odd path = %v, want nil", k)
+	}
+}
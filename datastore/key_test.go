@@ -0,0 +1,70 @@
+package datastore
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"testing"
+)
+
+func TestKeyUnmarshalJSONNull(t *testing.T) {
+	var v struct {
+		Owner *Key
+	}
+	if err := json.Unmarshal([]byte(`{"Owner":null}`), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Owner != nil {
+		t.Errorf("Owner is %v, want nil", v.Owner)
+	}
+
+	k := &Key{kind: "User", stringID: "a", appID: "app"}
+	if err := k.UnmarshalJSON([]byte("null")); err != nil {
+		t.Fatal(err)
+	}
+	if k.kind != "User" || k.stringID != "a" {
+		t.Errorf("UnmarshalJSON(null) changed the key to %v", k.Path())
+	}
+}
+
+func TestKeyJSONRoundTrip(t *testing.T) {
+	parent := &Key{kind: "Org", stringID: "acme", appID: "app", namespace: "ns"}
+	k := &Key{kind: "User", intID: 42, parent: parent, appID: "app", namespace: "ns"}
+
+	b, err := json.Marshal(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var back *Key
+	if err := json.Unmarshal(b, &back); err != nil {
+		t.Fatal(err)
+	}
+	if !back.Equal(k) {
+		t.Errorf("JSON %s decoded to %v, want %v", b, back.Path(), k.Path())
+	}
+}
+
+func TestDecodeCloudKey(t *testing.T) {
+	t.Setenv("GAE_APPLICATION", "s~test-app")
+	datastore.EnableKeyConversion(context.Background())
+
+	// the google.datastore.v1.Key of /User,a as cloud.google.com/go/datastore
+	// encodes it: path (2) holding an element with kind (1) and name (3)
+	cloud := base64.RawURLEncoding.EncodeToString([]byte{
+		0x12, 0x09,
+		0x0a, 0x04, 'U', 's', 'e', 'r',
+		0x1a, 0x01, 'a',
+	})
+	if _, err := decodeKey(cloud); err == nil {
+		t.Fatal("the offline decoder should not know cloud keys")
+	}
+
+	k, err := DecodeKey(cloud)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Path() != "User,a" || k.appID != "s~test-app" {
+		t.Errorf("DecodeKey(%s) = %s in %s, want User,a in s~test-app", cloud, k.Path(), k.appID)
+	}
+}
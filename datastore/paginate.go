@@ -0,0 +1,83 @@
+//go:build go1.18
+
+package datastore
+
+import (
+	"errors"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// Page is a page of results returned by Paginate.
+type Page[T any] struct {
+	// Entities is empty for keys-only queries
+	Entities []T
+	Keys     []*Key
+	// Next is the token of the next page, it is empty on the last page
+	Next    string
+	HasMore bool
+}
+
+// Paginate runs q for the page starting at token, an empty token being the
+// first page, and returns the entities of the page as a []T, T being a
+// struct or a pointer to one, along with their keys. Like GetAll, a field
+// mismatch still returns the page along with the first mismatch.
+//
+// The token is decoded by DecodeCursor and the query is run as
+// q.Start(cursor).Limit(pageSize+1), reading one more row to know whether
+// there is a next page, so a MockQuery should expect that query and a
+// MockCursor for the token. Queries with OR, IN or != filters have no
+// cursors and cannot be paginated.
+func Paginate[T any](ctx context.Context, q *Query, pageSize int, token string) (*Page[T], error) {
+	if pageSize <= 0 {
+		return nil, errors.New("datastore: page size should be positive")
+	}
+
+	if token != "" {
+		c, err := DecodeCursor(ctx, token)
+		if err != nil {
+			return nil, err
+		}
+		q = q.Start(c)
+	}
+
+	it := q.Limit(pageSize + 1).Run(ctx)
+	page := &Page[T]{}
+	var errFieldMismatch error
+	for len(page.Keys) < pageSize {
+		row, dst := newRow[T]()
+		k, err := it.Next(dst)
+		if err == Done {
+			return page, errFieldMismatch
+		}
+		if _, ok := err.(*datastore.ErrFieldMismatch); ok {
+			if errFieldMismatch == nil {
+				errFieldMismatch = err
+			}
+		} else if err != nil {
+			return nil, err
+		}
+
+		page.Keys = append(page.Keys, k)
+		if !q.keysOnly {
+			page.Entities = append(page.Entities, *row)
+		}
+	}
+
+	c, err := it.Cursor()
+	if err != nil {
+		return nil, err
+	}
+
+	// the extra row only tells whether the page is the last one
+	_, err = it.Next(nil)
+	switch err {
+	case nil:
+		page.HasMore = true
+		page.Next = c.String()
+	case Done:
+	default:
+		return nil, err
+	}
+	return page, errFieldMismatch
+}
@@ -0,0 +1,76 @@
+//go:build go1.18
+
+package datastore
+
+import (
+	gaemock "github.com/ahmadmuzakki/gae/mock"
+	"testing"
+)
+
+func TestPaginate(t *testing.T) {
+	ctx, dm := NewMock(gaemock.NewMock())
+	a := dm.ExpectKey(ctx, "User", "a", 0, nil)
+	b := dm.ExpectKey(ctx, "User", "b", 0, nil)
+	c := dm.ExpectKey(ctx, "User", "c", 0, nil)
+	ctx, mq := NewMockQuery(ctx)
+
+	// the first page reads a row past its size, which tells there is more
+	mq.ExpectQuery("User").Limit(3).ExpectResult(
+		QueryExpectation{Key: a, Value: &mockUser{"a"}},
+		QueryExpectation{Key: b, Value: &mockUser{"b"}, Cursor: "after-b"},
+		QueryExpectation{Key: c, Value: &mockUser{"c"}},
+	)
+	page, err := Paginate[*mockUser](ctx, NewQuery(ctx, "User"), 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Entities) != 2 || page.Entities[0].Name != "a" || page.Entities[1].Name != "b" {
+		t.Errorf("first page has %v, want a and b", page.Entities)
+	}
+	if len(page.Keys) != 2 || page.Keys[0] != a || page.Keys[1] != b {
+		t.Errorf("first page has the keys %v, want %v and %v", page.Keys, a, b)
+	}
+	if !page.HasMore || page.Next != "after-b" {
+		t.Errorf("first page has more %v with the token %q, want true with after-b", page.HasMore, page.Next)
+	}
+
+	// the token is decoded through the mock
+	mq.MockCursor("after-b")
+	mq.ExpectQuery("User").Start(Cursor{cursorStr: "after-b"}).Limit(3).ExpectResult(
+		QueryExpectation{Key: c, Value: &mockUser{"c"}},
+	)
+	last, err := Paginate[mockUser](ctx, NewQuery(ctx, "User"), 2, page.Next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(last.Entities) != 1 || last.Entities[0].Name != "c" || len(last.Keys) != 1 || last.Keys[0] != c {
+		t.Errorf("last page has %v with the keys %v, want c", last.Entities, last.Keys)
+	}
+	if last.HasMore || last.Next != "" {
+		t.Errorf("last page has more %v with the token %q, want false without one", last.HasMore, last.Next)
+	}
+}
+
+func TestPaginateFullLastPage(t *testing.T) {
+	ctx, dm := NewMock(gaemock.NewMock())
+	a := dm.ExpectKey(ctx, "User", "a", 0, nil)
+	ctx, mq := NewMockQuery(ctx)
+
+	// a page filled by the last rows has no next page
+	mq.ExpectQuery("User").KeysOnly().Limit(2).ExpectResult(QueryExpectation{Key: a})
+	page, err := Paginate[mockUser](ctx, NewQuery(ctx, "User").KeysOnly(), 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Keys) != 1 || len(page.Entities) != 0 || page.HasMore || page.Next != "" {
+		t.Errorf("page has the keys %v, %v and more %v with the token %q, want one key and no more",
+			page.Keys, page.Entities, page.HasMore, page.Next)
+	}
+}
+
+func TestPaginateUnexpectedToken(t *testing.T) {
+	ctx, _ := NewMockQuery(gaemock.NewMock())
+	if _, err := Paginate[mockUser](ctx, NewQuery(ctx, "User"), 2, "unknown"); err == nil {
+		t.Error("Paginate should fail for a token the mock does not expect")
+	}
+}
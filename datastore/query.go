@@ -1,47 +1,127 @@
 package datastore
 
 import (
+	"errors"
+	"fmt"
 	"golang.org/x/net/context"
+	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
+	"math"
 	"strings"
 )
 
+type operator int
+
+const (
+	lessThan operator = iota
+	lessEq
+	equal
+	greaterEq
+	greaterThan
+
+	// notEqual and in are not supported by the datastore, queries using them
+	// are split into several queries whose results are merged
+	notEqual
+	in
+)
+
+var operatorToString = map[operator]string{
+	lessThan:    "<",
+	lessEq:      "<=",
+	equal:       "=",
+	greaterEq:   ">=",
+	greaterThan: ">",
+	notEqual:    "!=",
+	in:          "IN",
+}
+
+func (op operator) String() string {
+	return operatorToString[op]
+}
+
+func (op operator) isInequality() bool {
+	return op != equal && op != in
+}
+
 type filter struct {
 	Field string
+	Op    operator
 	Value interface{}
 }
 
+// parseFilter splits a filter string such as "Age >=" into its property name
+// and operator.
+func parseFilter(filterStr string) (filter, error) {
+	filterStr = strings.TrimSpace(filterStr)
+	if filterStr == "" {
+		return filter{}, errors.New("datastore: invalid filter: " + filterStr)
+	}
+
+	propName := strings.TrimRight(filterStr, " ><=!")
+	if propName == "" {
+		return filter{}, errors.New("datastore: empty query filter field name")
+	}
+
+	opStr := strings.TrimSpace(filterStr[len(propName):])
+	for op, s := range operatorToString {
+		if s == opStr {
+			return filter{Field: propName, Op: op}, nil
+		}
+	}
+	return filter{}, fmt.Errorf("datastore: invalid operator %q in filter %q", opStr, filterStr)
+}
+
+// addFilter parses and appends a filter, keeping the first error in q.err.
+// The datastore only allows inequality filters on a single property.
+func (q *Query) addFilter(filterStr string, value interface{}) {
+	f, err := parseFilter(filterStr)
+	if err != nil {
+		if q.err == nil {
+			q.err = err
+		}
+		return
+	}
+	f.Value = value
+
+	if f.Op.isInequality() {
+		for _, other := range q.filter {
+			if other.Op.isInequality() && other.Field != f.Field && q.err == nil {
+				q.err = fmt.Errorf("datastore: inequality filters on multiple properties: %q and %q", other.Field, f.Field)
+			}
+		}
+	}
+	q.filter = append(q.filter, f)
+}
+
 func NewQuery(ctx context.Context, kind string) *Query {
 	query := &Query{
 		kind:  kind,
 		limit: -1,
 	}
-	if _, ok := isMockQuery(ctx); !ok {
-		query.queryDs = datastore.NewQuery(kind)
-	}
 	return query
 }
 
-// Query represents a datastore query.
+// Query represents a datastore query. It only describes the query, the SDK
+// query is built when it runs so the same Query works with the mock.
 type Query struct {
 	kind       string
 	ancestor   *Key
 	filter     []filter
 	order      []string
 	projection []string
+	// or holds the queries combined by Or
+	or []*Query
 
 	distinct bool
 	keysOnly bool
 	eventual bool
 	limit    int32
 	offset   int32
-	start    string
-	end      string
+	// start and end bound the results to the range [start, end)
+	start Cursor
+	end   Cursor
 
-	cursor Cursor
-
-	err     error
-	queryDs *datastore.Query
+	err error
 }
 
 func (q *Query) clone() *Query {
@@ -64,10 +144,13 @@ func (q *Query) Ancestor(ancestor *Key) *Query {
 	return q
 }
 
+// Filter returns a derivative query with a field-based filter. The filterStr
+// argument must be a field name followed by optional space, followed by an
+// operator, one of ">", "<", ">=", "<=", "=" or "!=". An invalid filter is
+// reported when the query runs.
 func (q *Query) Filter(filterStr string, value interface{}) *Query {
 	q = q.clone()
-	q.filter = append(q.filter, filter{Field: filterStr, Value: value})
-	q.queryDs = q.queryDs.Filter(filterStr, value)
+	q.addFilter(filterStr, value)
 	return q
 }
 
@@ -75,14 +158,12 @@ func (q *Query) Order(fieldName string) *Query {
 	q = q.clone()
 	fieldName = strings.TrimSpace(fieldName)
 	q.order = append(q.order, fieldName)
-	q.queryDs = q.queryDs.Order(fieldName)
 	return q
 }
 
 func (q *Query) Project(fieldNames ...string) *Query {
 	q = q.clone()
 	q.projection = append([]string(nil), fieldNames...)
-	q.queryDs = q.queryDs.Project(fieldNames...)
 	return q
 }
 
@@ -92,7 +173,6 @@ func (q *Query) Project(fieldNames ...string) *Query {
 func (q *Query) Distinct() *Query {
 	q = q.clone()
 	q.distinct = true
-	q.queryDs = q.queryDs.Distinct()
 	return q
 }
 
@@ -101,7 +181,6 @@ func (q *Query) Distinct() *Query {
 func (q *Query) KeysOnly() *Query {
 	q = q.clone()
 	q.keysOnly = true
-	q.queryDs = q.queryDs.KeysOnly()
 	return q
 }
 
@@ -109,8 +188,11 @@ func (q *Query) KeysOnly() *Query {
 // returned. A negative value means unlimited.
 func (q *Query) Limit(limit int) *Query {
 	q = q.clone()
+	if limit < math.MinInt32 || limit > math.MaxInt32 {
+		q.err = errors.New("datastore: query limit overflow")
+		return q
+	}
 	q.limit = int32(limit)
-	q.queryDs = q.queryDs.Limit(limit)
 	return q
 }
 
@@ -118,69 +200,179 @@ func (q *Query) Limit(limit int) *Query {
 // skip over before returning results. A negative value is invalid.
 func (q *Query) Offset(offset int) *Query {
 	q = q.clone()
+	if offset < 0 {
+		q.err = errors.New("datastore: negative query offset")
+		return q
+	}
+	if offset > math.MaxInt32 {
+		q.err = errors.New("datastore: query offset overflow")
+		return q
+	}
 	q.offset = int32(offset)
-	q.queryDs = q.queryDs.Offset(offset)
 	return q
 }
 
 // Start returns a derivative query with the given start point.
 func (q *Query) Start(c Cursor) *Query {
 	q = q.clone()
-	q.cursor = c
-
-	q.queryDs = q.queryDs.Start(c.dsCursor)
+	q.start = c
 	return q
 }
 
-// End returns a derivative query with the given end point.
+// End returns a derivative query with the given end point, which is not part
+// of the results.
 func (q *Query) End(c Cursor) *Query {
 	q = q.clone()
-	q.cursor = c
-
-	q.queryDs = q.queryDs.End(c.dsCursor)
+	q.end = c
 	return q
 }
 
-func (q *Query) preRun(ctx context.Context) {
+// compile builds the SDK queries described by q, one for every branch of its
+// OR, IN and != filters, and returns the context to run them in, which has
+// the namespace of the ancestor.
+func (q *Query) compile(ctx context.Context) ([]*datastore.Query, context.Context, error) {
+	if q.err != nil {
+		return nil, ctx, q.err
+	}
+
+	dq := datastore.NewQuery(q.kind)
 	if q.ancestor != nil {
 		dsKey := ConvertKeyToDsKey(ctx, q.ancestor)
-		q.queryDs = q.queryDs.Ancestor(dsKey)
+		dq = dq.Ancestor(dsKey)
+
+		if nsCtx, err := appengine.Namespace(ctx, dsKey.Namespace()); err == nil {
+			ctx = nsCtx
+		}
+	}
+	for _, o := range q.order {
+		dq = dq.Order(o)
+	}
+	if len(q.projection) > 0 {
+		dq = dq.Project(q.projection...)
+	}
+	if q.distinct {
+		dq = dq.Distinct()
+	}
+	if q.eventual {
+		dq = dq.EventualConsistency()
+	}
+
+	branches := q.branches()
+	if len(branches) != 1 {
+		// the branches are merged in memory, so each of them fetches enough
+		// rows to cover the offset and the limit of the whole query
+		if q.start.String() != "" || q.end.String() != "" {
+			return nil, ctx, errMergedCursor
+		}
+		if q.keysOnly && !q.mergeNeedsProperties() {
+			dq = dq.KeysOnly()
+		}
+		if q.limit >= 0 {
+			dq = dq.Limit(int(q.limit) + int(q.offset))
+		}
+	} else {
+		if q.keysOnly {
+			dq = dq.KeysOnly()
+		}
+		dq = dq.Limit(int(q.limit))
+		if q.offset != 0 {
+			dq = dq.Offset(int(q.offset))
+		}
+		if s := q.start.String(); s != "" {
+			c, err := datastore.DecodeCursor(s)
+			if err != nil {
+				return nil, ctx, err
+			}
+			dq = dq.Start(c)
+		}
+		if s := q.end.String(); s != "" {
+			c, err := datastore.DecodeCursor(s)
+			if err != nil {
+				return nil, ctx, err
+			}
+			dq = dq.End(c)
+		}
 	}
 
+	dqs := make([]*datastore.Query, len(branches))
+	for i, filters := range branches {
+		dqs[i] = dq
+		for _, f := range filters {
+			value := f.Value
+			// the SDK only compares its own keys
+			switch k := value.(type) {
+			case *Key:
+				value = ConvertKeyToDsKey(ctx, k)
+			case typedKey:
+				value = ConvertKeyToDsKey(ctx, k.untyped())
+			}
+			dqs[i] = dqs[i].Filter(f.Field+" "+f.Op.String(), value)
+		}
+	}
+	return dqs, ctx, nil
 }
 
 func (q *Query) Count(c context.Context) (int, error) {
-	q.preRun(c)
-	// intercept for mock
-	return q.queryDs.Count(c)
+	if mock, ok := isMockQuery(c); ok {
+		return mock.count(c, q)
+	}
+
+	if len(q.branches()) != 1 {
+		return q.countMerged(c)
+	}
+
+	dqs, c, err := q.compile(c)
+	if err != nil {
+		return 0, err
+	}
+	return dqs[0].Count(c)
 }
 
 func (q *Query) GetAll(ctx context.Context, dst interface{}) ([]*Key, error) {
-	q.preRun(ctx)
-
 	if mock, ok := isMockQuery(ctx); ok {
 		return mock.getAll(ctx, q, dst)
 	}
 
-	dskeys, err := q.queryDs.GetAll(ctx, dst)
+	dqs, ctx, err := q.compile(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(dqs) != 1 {
+		return q.getAllMerged(ctx, dqs, dst)
+	}
+
+	dskeys, err := getAll(ctx, dqs[0], dst)
 	keys := convertDsKeysToKeys(ctx, dskeys)
 	return keys, err
 }
 
 // Run runs the query in the given context.
 func (q *Query) Run(ctx context.Context) *Iterator {
-	q.preRun(ctx)
-
 	if mock, ok := isMockQuery(ctx); ok {
 		return mock.run(ctx, q)
 	}
 
-	it := q.queryDs.Run(ctx)
-	return &Iterator{
-		iter:   it,
-		cursor: q.cursor,
-		c:      ctx,
+	it := &Iterator{
+		cursor:   q.start,
+		keysOnly: q.keysOnly,
 	}
+
+	dqs, ctx, err := q.compile(ctx)
+	it.c = ctx
+	if err != nil {
+		it.err = err
+		return it
+	}
+
+	if len(dqs) != 1 {
+		it.merged = true
+		it.rows, it.err = q.runMerged(ctx, dqs)
+		return it
+	}
+
+	it.iter = dqs[0].Run(ctx)
+	return it
 }
 
 type Cursor struct {
@@ -190,7 +382,11 @@ type Cursor struct {
 }
 
 func (c *Cursor) String() string {
-	return c.dsCursor.String()
+	// mock cursors only have their string
+	if s := c.dsCursor.String(); s != "" {
+		return s
+	}
+	return c.cursorStr
 }
 
 func DecodeCursor(ctx context.Context, s string) (Cursor, error) {
@@ -216,6 +412,12 @@ type Iterator struct {
 
 	// current row of iterator
 	index int
+
+	// merged is set for queries with OR, IN or != filters, whose rows are
+	// fetched and merged up front
+	merged   bool
+	rows     []queryRow
+	keysOnly bool
 }
 
 func (i *Iterator) Next(dst interface{}) (*Key, error) {
@@ -227,15 +429,30 @@ func (i *Iterator) Next(dst interface{}) (*Key, error) {
 		return mock.next(i, dst)
 	}
 
-	k, err := i.iter.Next(dst)
-	if err != nil {
-		return nil, err
+	if i.merged {
+		return i.nextMerged(dst)
 	}
-	return ConvertDsKeyToKey(k), nil
+
+	// the key comes with an ErrFieldMismatch, like the entity
+	k, err := i.iter.Next(newEntity(i.c, dst))
+	return ConvertDsKeyToKey(k), err
 }
 
 func (i *Iterator) Cursor() (Cursor, error) {
+	if mock, ok := isMockQuery(i.c); ok {
+		return mock.cursor(i)
+	}
+
+	if i.merged {
+		return i.cursor, errMergedCursor
+	}
+
+	if i.iter == nil {
+		return i.cursor, i.err
+	}
+
 	c, err := i.iter.Cursor()
 	i.cursor.dsCursor = c
+	i.cursor.cursorStr = c.String()
 	return i.cursor, err
 }
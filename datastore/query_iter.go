@@ -0,0 +1,72 @@
+//go:build go1.23
+
+package datastore
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"iter"
+)
+
+// All runs the query and yields the key of every result, for use in a range
+// loop. An error is yielded with a nil key and ends the sequence. Breaking
+// out of the loop stops reading results. The entities are not loaded, see
+// Rows to get them.
+func (q *Query) All(ctx context.Context) iter.Seq2[*Key, error] {
+	return func(yield func(*Key, error) bool) {
+		it := q.Run(ctx)
+		for {
+			k, err := it.Next(nil)
+			if err == Done {
+				return
+			}
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			if !yield(k, nil) {
+				return
+			}
+		}
+	}
+}
+
+// Rows runs q and yields the key and the entity of every result, which is
+// loaded into a new T. T is a struct or a pointer to one. The sequence ends
+// at the first error, which the returned function reports once the loop is
+// done. A field mismatch doesn't end it: the row is yielded and the first
+// mismatch is reported unless another error follows.
+//
+//	rows, errFn := datastore.Rows[User](ctx, q)
+//	for k, u := range rows {
+//		...
+//	}
+//	if err := errFn(); err != nil {
+//		...
+//	}
+func Rows[T any](ctx context.Context, q *Query) (iter.Seq2[*Key, T], func() error) {
+	var err error
+	seq := func(yield func(*Key, T) bool) {
+		err = nil
+		it := q.Run(ctx)
+		for {
+			row, dst := newRow[T]()
+			k, nextErr := it.Next(dst)
+			if nextErr == Done {
+				return
+			}
+			if _, ok := nextErr.(*datastore.ErrFieldMismatch); ok {
+				if err == nil {
+					err = nextErr
+				}
+			} else if nextErr != nil {
+				err = nextErr
+				return
+			}
+			if !yield(k, *row) {
+				return
+			}
+		}
+	}
+	return seq, func() error { return err }
+}
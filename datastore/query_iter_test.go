@@ -0,0 +1,60 @@
+//go:build go1.23
+
+package datastore
+
+import (
+	"errors"
+	gaemock "github.com/ahmadmuzakki/gae/mock"
+	"google.golang.org/appengine/datastore"
+	"testing"
+)
+
+func TestRowsFieldMismatch(t *testing.T) {
+	ctx, dm := NewMock(gaemock.NewMock())
+	k1 := dm.ExpectKey(ctx, "User", "a", 0, nil)
+	k2 := dm.ExpectKey(ctx, "User", "b", 0, nil)
+	ctx, mq := NewMockQuery(ctx)
+
+	mismatch := &datastore.ErrFieldMismatch{FieldName: "Age", Reason: "no such struct field"}
+	mq.ExpectQuery("User").ExpectResult(
+		QueryExpectation{Key: k1, Value: &mockUser{"a"}, Err: mismatch},
+		QueryExpectation{Key: k2, Value: &mockUser{"b"}},
+	)
+
+	rows, errFn := Rows[*mockUser](ctx, NewQuery(ctx, "User"))
+	var names []string
+	for k, u := range rows {
+		if k == nil {
+			t.Fatal("Rows yielded a nil key")
+		}
+		names = append(names, u.Name)
+	}
+	if len(names) != 2 || names[0] != "a" || names[1] != "b" {
+		t.Errorf("Rows yielded %v, want [a b]", names)
+	}
+	if err := errFn(); err != mismatch {
+		t.Errorf("Rows reported %v, want %v", err, mismatch)
+	}
+}
+
+func TestRowsError(t *testing.T) {
+	ctx, dm := NewMock(gaemock.NewMock())
+	k1 := dm.ExpectKey(ctx, "User", "a", 0, nil)
+	ctx, mq := NewMockQuery(ctx)
+
+	boom := errors.New("boom")
+	mq.ExpectQuery("User").ExpectResult(
+		QueryExpectation{Key: k1, Value: &mockUser{"a"}},
+		QueryExpectation{Err: boom},
+		QueryExpectation{Key: k1, Value: &mockUser{"c"}},
+	)
+
+	rows, errFn := Rows[mockUser](ctx, NewQuery(ctx, "User"))
+	n := 0
+	for range rows {
+		n++
+	}
+	if n != 1 || errFn() != boom {
+		t.Errorf("Rows yielded %d rows and %v, want 1 row and %v", n, errFn(), boom)
+	}
+}
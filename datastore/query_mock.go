@@ -30,28 +30,65 @@ func (mq *MockQuery) ExpectQuery(kind string) *MockQueryAction {
 	return mock
 }
 
-func (mq *MockQuery) run(ctx context.Context, q *Query) (it *Iterator) {
+func (mq *MockQuery) run(ctx context.Context, q *Query) *Iterator {
+	it := &Iterator{
+		c:      ctx,
+		cursor: q.start,
+	}
+
+	if q.err != nil {
+		it.err = q.err
+		return it
+	}
+
 	if len(mq.mocks) == 0 {
 		it.err = fmt.Errorf("No more expectations")
-		return
+		return it
 	}
 
 	mock := mq.mocks[0]
 
-	if !reflect.DeepEqual(mock.query, q) {
-		it.err = fmt.Errorf("Query %+v did not match with expected %+v", q, mock.query)
-		return
+	if err := matchQuery(mock.query, q); err != nil {
+		it.err = err
+		return it
 	}
 
-	ctx = mq.setValue(ctx, mock.expectation)
-	it.c = ctx
+	it.c = mq.setValue(ctx, mock.expectation)
 
 	mq.trimMock()
 
-	return
+	return it
 }
 
 func (mq *MockQuery) getAll(ctx context.Context, q *Query, dst interface{}) ([]*Key, error) {
+	if q.err != nil {
+		return nil, q.err
+	}
+
+	if len(mq.mocks) == 0 {
+		return nil, fmt.Errorf("No more expectations")
+	}
+
+	mock := mq.mocks[0]
+
+	if err := matchQuery(mock.query, q); err != nil {
+		return nil, err
+	}
+
+	mq.trimMock()
+
+	// dst is ignored by keys-only queries
+	if q.keysOnly {
+		keys := make([]*Key, 0, len(mock.expectation))
+		for _, expect := range mock.expectation {
+			if expect.Err != nil {
+				return keys, expect.Err
+			}
+			keys = append(keys, expect.Key)
+		}
+		return keys, nil
+	}
+
 	if reflect.TypeOf(dst).Kind() != reflect.Ptr {
 		return nil, fmt.Errorf("%s", "Destination should be pointer")
 	}
@@ -61,40 +98,95 @@ func (mq *MockQuery) getAll(ctx context.Context, q *Query, dst interface{}) ([]*
 		return nil, fmt.Errorf("%s", "Destination is not array")
 	}
 
-	if len(mq.mocks) == 0 {
-		return nil, fmt.Errorf("No more expectations")
-	}
-
-	mock := mq.mocks[0]
+	keys := make([]*Key, 0, len(mock.expectation))
 	for _, expect := range mock.expectation {
-		// get the slice item Type
-		itemType := sliceDest.Type().Elem()
-		// new row of slice element
-		// we use indirect because itemType is pointer
-		newRow := reflect.Indirect(reflect.New(itemType))
-		val := reflect.ValueOf(expect.Value)
+		if expect.Err != nil {
+			return keys, expect.Err
+		}
 
+		val := reflect.ValueOf(expect.Value)
 		if val.Type().Kind() != reflect.Ptr {
-			return nil, fmt.Errorf("Expected value should be pointer")
+			return keys, fmt.Errorf("Expected value should be pointer")
 		}
 
-		newRow.Set(reflect.Indirect(val))
+		// get the slice item Type
+		itemType := sliceDest.Type().Elem()
+		// new row of slice element, a *S element points to a new S
+		var newRow reflect.Value
+		if itemType.Kind() == reflect.Ptr {
+			newRow = reflect.New(itemType.Elem())
+			newRow.Elem().Set(reflect.Indirect(val))
+		} else {
+			newRow = reflect.Indirect(reflect.New(itemType))
+			newRow.Set(reflect.Indirect(val))
+		}
 
 		sliceDest.Set(reflect.Append(sliceDest, newRow))
+		keys = append(keys, expect.Key)
 	}
 
-	mq.trimMock()
-
-	return nil, nil
+	return keys, nil
 }
 
-func (mq *MockQuery) count(ctx context.Context) (int, error) {
+func (mq *MockQuery) count(ctx context.Context, q *Query) (int, error) {
+	if q.err != nil {
+		return 0, q.err
+	}
+
 	if len(mq.mocks) == 0 {
 		return 0, fmt.Errorf("No more expectations")
 	}
-	c := len(mq.mocks[0].expectation)
+
+	mock := mq.mocks[0]
+
+	if err := matchQuery(mock.query, q); err != nil {
+		return 0, err
+	}
+
 	mq.trimMock()
-	return c, nil
+
+	if mock.countErr != nil {
+		return 0, mock.countErr
+	}
+
+	// without ExpectCount the count is the number of expected results
+	if mock.count != nil {
+		return *mock.count, nil
+	}
+	return len(mock.expectation), nil
+}
+
+// matchQuery compares the query run by the code with the expected one and
+// describes them side by side in GQL when they differ.
+func matchQuery(expected, actual *Query) error {
+	if reflect.DeepEqual(expected, actual) {
+		return nil
+	}
+
+	expectedGQL, actualGQL := expected.GQL(), actual.GQL()
+	if expectedGQL == actualGQL {
+		// e.g. Filter("Age =", 3) and Filter("Age =", int64(3))
+		return fmt.Errorf("Query did not match with expected, their GQL is the same but the types of their values or their settings differ\n\texpected: %s\n\tactual:   %s\n\texpected filters: %s\n\tactual filters:   %s",
+			expectedGQL, actualGQL, filterTypes(expected), filterTypes(actual))
+	}
+	return fmt.Errorf("Query did not match with expected\n\texpected: %s\n\tactual:   %s", expectedGQL, actualGQL)
+}
+
+// filterTypes lists the filters of q with the types of their values.
+func filterTypes(q *Query) string {
+	filters := make([]string, len(q.filter))
+	for i, f := range q.filter {
+		values := []interface{}{f.Value}
+		if f.Op == in {
+			values = f.Value.([]interface{})
+		}
+		typed := make([]string, len(values))
+		for j, v := range values {
+			typed[j] = fmt.Sprintf("%T(%v)", v, v)
+		}
+		filters[i] = f.Field + " " + f.Op.String() + " " + strings.Join(typed, ", ")
+	}
+	return strings.Join(filters, "; ")
 }
 
 func (mq *MockQuery) trimMock() {
@@ -123,13 +215,30 @@ func (mq *MockQuery) next(i *Iterator, dst interface{}) (*Key, error) {
 		return nil, datastore.Done
 	}
 
-	dir := reflect.Indirect(reflect.ValueOf(dst))
 	expect := values[i.index]
-	value := reflect.ValueOf(expect.Value)
-	directValue := reflect.Indirect(value)
-	dir.Set(directValue)
 	i.index += 1
-	return expect.Key, nil
+
+	if dst != nil && expect.Value != nil {
+		dir := reflect.Indirect(reflect.ValueOf(dst))
+		value := reflect.ValueOf(expect.Value)
+		directValue := reflect.Indirect(value)
+		dir.Set(directValue)
+	}
+	return expect.Key, expect.Err
+}
+
+// cursor returns the cursor after the last row read by the iterator, which
+// is the start cursor of the query before the first row.
+func (mq *MockQuery) cursor(i *Iterator) (Cursor, error) {
+	if i.err != nil || i.index == 0 {
+		return i.cursor, i.err
+	}
+
+	expect := mq.getValue(i.c)[i.index-1]
+	if expect.Cursor != "" {
+		return Cursor{cursorStr: expect.Cursor}, nil
+	}
+	return Cursor{cursorStr: fmt.Sprintf("mock-cursor-%d", i.index)}, nil
 }
 
 func (mq *MockQuery) MockCursor(str string) {
@@ -155,17 +264,34 @@ var Done = datastore.Done
 type MockQueryAction struct {
 	query       *Query
 	expectation []QueryExpectation
+	count       *int
+	countErr    error
 }
 
+// QueryExpectation is a row returned by the expected query. Err is returned
+// by Next along with Key for that row, and Cursor is the cursor after the row,
+// which defaults to mock-cursor-N for the Nth row.
 type QueryExpectation struct {
-	Key   *Key
-	Value interface{}
+	Key    *Key
+	Value  interface{}
+	Err    error
+	Cursor string
 }
 
 func (action *MockQueryAction) ExpectResult(results ...QueryExpectation) {
 	action.expectation = results
 }
 
+// ExpectCount sets the result of Count for the expected query.
+func (action *MockQueryAction) ExpectCount(n int) {
+	action.count = &n
+}
+
+// ExpectCountErr makes Count of the expected query fail with err.
+func (action *MockQueryAction) ExpectCountErr(err error) {
+	action.countErr = err
+}
+
 func (action *MockQueryAction) Ancestor(ancestor *Key) *MockQueryAction {
 	q := action.query.clone()
 	q.ancestor = ancestor
@@ -175,7 +301,26 @@ func (action *MockQueryAction) Ancestor(ancestor *Key) *MockQueryAction {
 
 func (action *MockQueryAction) Filter(filterStr string, value interface{}) *MockQueryAction {
 	q := action.query.clone()
-	q.filter = append(q.filter, filter{Field: filterStr, Value: value})
+	q.addFilter(filterStr, value)
+	action.query = q
+	return action
+}
+
+func (action *MockQueryAction) FilterIn(field string, values ...interface{}) *MockQueryAction {
+	action.query = action.query.FilterIn(field, values...)
+	return action
+}
+
+func (action *MockQueryAction) FilterNotEqual(field string, value interface{}) *MockQueryAction {
+	action.query = action.query.FilterNotEqual(field, value)
+	return action
+}
+
+// Or expects the query built by Or(queries...), which the mock matches as a
+// single query.
+func (action *MockQueryAction) Or(queries ...*Query) *MockQueryAction {
+	q := action.query.clone()
+	q.setOr(queries)
 	action.query = q
 	return action
 }
@@ -223,17 +368,19 @@ func (action *MockQueryAction) Offset(offset int) *MockQueryAction {
 	return action
 }
 
+// Start expects the query to start at c, matched apart from its end.
 func (action *MockQueryAction) Start(c Cursor) *MockQueryAction {
 	q := action.query.clone()
-	q.cursor = c
+	q.start = c
 
 	action.query = q
 	return action
 }
 
+// End expects the query to end at c, matched apart from its start.
 func (action *MockQueryAction) End(c Cursor) *MockQueryAction {
 	q := action.query.clone()
-	q.cursor = c
+	q.end = c
 
 	action.query = q
 	return action
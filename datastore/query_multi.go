@@ -0,0 +1,510 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The datastore has no OR, IN or != filters. A query using them is split
+// into branches of plain filters, one SDK query per branch, which run
+// concurrently and whose results are merged in memory: duplicate rows are
+// dropped, the rows are sorted by the orders of the query and the offset and
+// limit are applied to the merged rows.
+
+var errMergedCursor = errors.New("datastore: cursors are not supported by queries with OR, IN or != filters")
+
+// FilterIn returns a derivative query matching the entities whose field
+// equals one of values.
+func (q *Query) FilterIn(field string, values ...interface{}) *Query {
+	q = q.clone()
+	q.filter = append(q.filter, filter{
+		Field: strings.TrimSpace(field),
+		Op:    in,
+		Value: append([]interface{}(nil), values...),
+	})
+	return q
+}
+
+// FilterNotEqual returns a derivative query matching the entities whose
+// field differs from value. It is an inequality filter on field.
+func (q *Query) FilterNotEqual(field string, value interface{}) *Query {
+	q = q.clone()
+	q.addFilter(field+" !=", value)
+	return q
+}
+
+// Or returns a query matching the entities matched by any of queries. The
+// queries must be of the same kind and only have filters; ancestor, orders,
+// limit and the other settings go on the returned query, which can also be
+// filtered further.
+func Or(queries ...*Query) *Query {
+	q := &Query{
+		limit: -1,
+	}
+	q.setOr(queries)
+	return q
+}
+
+func (q *Query) setOr(queries []*Query) {
+	if len(queries) == 0 {
+		q.err = errors.New("datastore: Or needs at least one query")
+		return
+	}
+	if q.kind == "" {
+		q.kind = queries[0].kind
+	}
+
+	for _, sub := range queries {
+		switch {
+		case sub.err != nil:
+			q.err = sub.err
+		case sub.kind != q.kind:
+			q.err = errors.New("datastore: Or combines queries of different kinds")
+		case sub.ancestor != nil || len(sub.order) > 0 || len(sub.projection) > 0 || sub.distinct ||
+			sub.keysOnly || sub.limit != -1 || sub.offset != 0 || sub.start.String() != "" || sub.end.String() != "":
+			q.err = errors.New("datastore: Or only combines the filters of its queries")
+		}
+		if q.err != nil {
+			return
+		}
+	}
+	q.or = append([]*Query(nil), queries...)
+}
+
+// branches expands the OR, IN and != filters of q into lists of plain
+// filters, all of which have to match.
+func (q *Query) branches() [][]filter {
+	branches := [][]filter{nil}
+	if len(q.or) > 0 {
+		branches = nil
+		for _, sub := range q.or {
+			branches = append(branches, sub.branches()...)
+		}
+	}
+
+	for _, f := range q.filter {
+		var alternatives []filter
+		switch f.Op {
+		case in:
+			for _, v := range f.Value.([]interface{}) {
+				alternatives = append(alternatives, filter{Field: f.Field, Op: equal, Value: v})
+			}
+		case notEqual:
+			alternatives = []filter{
+				{Field: f.Field, Op: lessThan, Value: f.Value},
+				{Field: f.Field, Op: greaterThan, Value: f.Value},
+			}
+		default:
+			alternatives = []filter{f}
+		}
+
+		expanded := make([][]filter, 0, len(branches)*len(alternatives))
+		for _, b := range branches {
+			for _, a := range alternatives {
+				expanded = append(expanded, append(append([]filter(nil), b...), a))
+			}
+		}
+		branches = expanded
+	}
+	return branches
+}
+
+// mergeNeedsProperties returns whether the rows have to be fetched with their
+// properties to be merged in order, even for a keys-only query.
+func (q *Query) mergeNeedsProperties() bool {
+	for _, o := range q.order {
+		if strings.TrimPrefix(o, "-") != "__key__" {
+			return true
+		}
+	}
+	return false
+}
+
+type queryRow struct {
+	key   *datastore.Key
+	props datastore.PropertyList
+}
+
+// runMerged runs the SDK queries of every branch concurrently and merges
+// their rows.
+func (q *Query) runMerged(ctx context.Context, dqs []*datastore.Query) ([]queryRow, error) {
+	withProps := !q.keysOnly || q.mergeNeedsProperties()
+
+	results := make([][]queryRow, len(dqs))
+	errs := make([]error, len(dqs))
+
+	var wg sync.WaitGroup
+	for i, dq := range dqs {
+		wg.Add(1)
+		go func(i int, dq *datastore.Query) {
+			defer wg.Done()
+
+			var (
+				props []datastore.PropertyList
+				keys  []*datastore.Key
+				err   error
+			)
+			if withProps {
+				keys, err = dq.GetAll(ctx, &props)
+			} else {
+				keys, err = dq.GetAll(ctx, nil)
+			}
+			if err != nil {
+				errs[i] = err
+				return
+			}
+
+			rows := make([]queryRow, len(keys))
+			for j, key := range keys {
+				rows[j].key = key
+				if j < len(props) {
+					rows[j].props = props[j]
+				}
+			}
+			results[i] = rows
+		}(i, dq)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rows := q.mergeRows(results)
+	if int(q.offset) >= len(rows) {
+		return nil, nil
+	}
+	rows = rows[q.offset:]
+	if q.limit >= 0 && int(q.limit) < len(rows) {
+		rows = rows[:q.limit]
+	}
+	return rows, nil
+}
+
+// mergeRows drops the rows found by several branches and sorts the others.
+func (q *Query) mergeRows(results [][]queryRow) []queryRow {
+	seen := make(map[string]bool)
+	var rows []queryRow
+	for _, result := range results {
+		for _, row := range result {
+			id := q.rowID(row)
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			rows = append(rows, row)
+		}
+	}
+
+	sort.SliceStable(rows, func(i, j int) bool {
+		return q.compareRows(rows[i], rows[j]) < 0
+	})
+	return rows
+}
+
+// rowID identifies a row among the rows of the branches. An entity is found
+// once, but a projection on a multi-valued property gives a row per value,
+// so projected rows are told apart by their values too, and a distinct
+// query only keeps one row of each set of values, whatever the entity.
+func (q *Query) rowID(row queryRow) string {
+	var id bytes.Buffer
+	if !q.distinct {
+		id.WriteString(row.key.Encode())
+	}
+	for _, field := range q.projection {
+		var value interface{}
+		for _, p := range row.props {
+			if p.Name == field {
+				value = p.Value
+				break
+			}
+		}
+
+		switch v := value.(type) {
+		case *datastore.Key:
+			fmt.Fprintf(&id, "|key %s", v.Encode())
+		case time.Time:
+			fmt.Fprintf(&id, "|time %d", orderInt(v))
+		default:
+			fmt.Fprintf(&id, "|%T %#v", v, v)
+		}
+	}
+	return id.String()
+}
+
+// countMerged is Count for the queries with OR, IN or != filters. The order
+// of the rows doesn't change their number, so only the keys are fetched.
+func (q *Query) countMerged(ctx context.Context) (int, error) {
+	cq := q.clone()
+	cq.order = nil
+	if len(cq.projection) == 0 {
+		cq.keysOnly = true
+	}
+
+	dqs, ctx, err := cq.compile(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := cq.runMerged(ctx, dqs)
+	return len(rows), err
+}
+
+// getAllMerged is GetAll for the queries with OR, IN or != filters.
+func (q *Query) getAllMerged(ctx context.Context, dqs []*datastore.Query, dst interface{}) ([]*Key, error) {
+	rows, err := q.runMerged(ctx, dqs)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]*Key, len(rows))
+	for i, row := range rows {
+		keys[i] = ConvertDsKeyToKey(row.key)
+	}
+
+	// dst is ignored by keys-only queries
+	if q.keysOnly {
+		return keys, nil
+	}
+
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Slice {
+		return nil, errors.New("datastore: dst has invalid type")
+	}
+
+	sliceDst := v.Elem()
+	elemType := sliceDst.Type().Elem()
+	isPtr := elemType.Kind() == reflect.Ptr
+	if isPtr {
+		elemType = elemType.Elem()
+	}
+
+	var errFieldMismatch error
+	for _, row := range rows {
+		elem := reflect.New(elemType)
+		if err := loadProperties(ctx, elem.Interface(), row.props); err != nil {
+			if _, ok := err.(*datastore.ErrFieldMismatch); !ok {
+				return keys, err
+			}
+			if errFieldMismatch == nil {
+				errFieldMismatch = err
+			}
+		}
+
+		if isPtr {
+			sliceDst.Set(reflect.Append(sliceDst, elem))
+		} else {
+			sliceDst.Set(reflect.Append(sliceDst, elem.Elem()))
+		}
+	}
+	return keys, errFieldMismatch
+}
+
+func (i *Iterator) nextMerged(dst interface{}) (*Key, error) {
+	if i.index == len(i.rows) {
+		return nil, Done
+	}
+
+	row := i.rows[i.index]
+	i.index++
+
+	key := ConvertDsKeyToKey(row.key)
+	if dst != nil && !i.keysOnly {
+		return key, loadProperties(i.c, dst, row.props)
+	}
+	return key, nil
+}
+
+// loadProperties loads props into dst the way the SDK would.
+func loadProperties(ctx context.Context, dst interface{}, props datastore.PropertyList) error {
+	if pls, ok := dst.(datastore.PropertyLoadSaver); ok {
+		return pls.Load(props)
+	}
+	if e, ok := newEntity(ctx, dst).(*entity); ok {
+		return e.Load(props)
+	}
+	return datastore.LoadStruct(dst, props)
+}
+
+// compareRows compares two rows by the orders of q and then by key, which
+// is the default order of the datastore.
+func (q *Query) compareRows(a, b queryRow) int {
+	for _, o := range q.order {
+		field := strings.TrimPrefix(o, "-")
+		desc := field != o
+
+		var c int
+		if field == "__key__" {
+			c = compareKeys(a.key, b.key)
+		} else {
+			c = compareValues(orderValue(a.props, field, desc), orderValue(b.props, field, desc))
+		}
+		if desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return compareKeys(a.key, b.key)
+}
+
+// orderValue returns the value of a property to sort by. A multi-valued
+// property sorts by its smallest value ascending and by its largest one
+// descending.
+func orderValue(props datastore.PropertyList, name string, desc bool) interface{} {
+	var (
+		value interface{}
+		found bool
+	)
+	for _, p := range props {
+		if p.Name != name {
+			continue
+		}
+		if !found {
+			value, found = p.Value, true
+			continue
+		}
+		c := compareValues(p.Value, value)
+		if (desc && c > 0) || (!desc && c < 0) {
+			value = p.Value
+		}
+	}
+	return value
+}
+
+// typeRank follows the datastore order of values of different types.
+func typeRank(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 0
+	case int64, time.Time:
+		return 1
+	case bool:
+		return 2
+	case []byte, datastore.ByteString:
+		return 3
+	case string:
+		return 4
+	case float64:
+		return 5
+	case appengine.GeoPoint:
+		return 6
+	case *datastore.Key:
+		return 7
+	}
+	return 8
+}
+
+func compareValues(a, b interface{}) int {
+	if ra, rb := typeRank(a), typeRank(b); ra != rb {
+		return compareInts(int64(ra), int64(rb))
+	}
+
+	switch a := a.(type) {
+	case int64, time.Time:
+		return compareInts(orderInt(a), orderInt(b))
+	case bool:
+		if a == b.(bool) {
+			return 0
+		}
+		if !a {
+			return -1
+		}
+		return 1
+	case []byte:
+		return bytes.Compare(a, toBytes(b))
+	case datastore.ByteString:
+		return bytes.Compare(a, toBytes(b))
+	case string:
+		return strings.Compare(a, b.(string))
+	case float64:
+		b := b.(float64)
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+		return 0
+	case appengine.GeoPoint:
+		b := b.(appengine.GeoPoint)
+		if a.Lat != b.Lat {
+			return compareValues(a.Lat, b.Lat)
+		}
+		return compareValues(a.Lng, b.Lng)
+	case *datastore.Key:
+		return compareKeys(a, b.(*datastore.Key))
+	}
+	return 0
+}
+
+// orderInt returns the datastore integer of an int64 or a time, which is
+// stored in microseconds.
+func orderInt(v interface{}) int64 {
+	if t, ok := v.(time.Time); ok {
+		return t.UnixNano() / int64(time.Microsecond)
+	}
+	return v.(int64)
+}
+
+func toBytes(v interface{}) []byte {
+	if b, ok := v.(datastore.ByteString); ok {
+		return b
+	}
+	return v.([]byte)
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// compareKeys compares keys element by element from the root. Integer IDs
+// sort before names, and an ancestor sorts before its descendants.
+func compareKeys(a, b *datastore.Key) int {
+	pa, pb := keyElements(a), keyElements(b)
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		x, y := pa[i], pb[i]
+		if c := strings.Compare(x.Kind(), y.Kind()); c != 0 {
+			return c
+		}
+		switch {
+		case x.StringID() == "" && y.StringID() != "":
+			return -1
+		case x.StringID() != "" && y.StringID() == "":
+			return 1
+		}
+		if c := compareInts(x.IntID(), y.IntID()); c != 0 {
+			return c
+		}
+		if c := strings.Compare(x.StringID(), y.StringID()); c != 0 {
+			return c
+		}
+	}
+	return compareInts(int64(len(pa)), int64(len(pb)))
+}
+
+func keyElements(k *datastore.Key) []*datastore.Key {
+	var elements []*datastore.Key
+	for ; k != nil; k = k.Parent() {
+		elements = append([]*datastore.Key{k}, elements...)
+	}
+	return elements
+}
@@ -0,0 +1,131 @@
+package datastore
+
+import (
+	"google.golang.org/appengine/datastore"
+	"reflect"
+	"testing"
+)
+
+func TestBranches(t *testing.T) {
+	q := Or(
+		NewQuery(nil, "User").Filter("A =", 1),
+		NewQuery(nil, "User").FilterIn("B", 1, 2),
+	).FilterNotEqual("C", 3)
+	if q.err != nil {
+		t.Fatal(q.err)
+	}
+
+	want := [][]filter{
+		{{"A", equal, 1}, {"C", lessThan, 3}},
+		{{"A", equal, 1}, {"C", greaterThan, 3}},
+		{{"B", equal, 1}, {"C", lessThan, 3}},
+		{{"B", equal, 1}, {"C", greaterThan, 3}},
+		{{"B", equal, 2}, {"C", lessThan, 3}},
+		{{"B", equal, 2}, {"C", greaterThan, 3}},
+	}
+	if got := q.branches(); !reflect.DeepEqual(got, want) {
+		t.Errorf("branches = %v, want %v", got, want)
+	}
+}
+
+func TestOrErrors(t *testing.T) {
+	tests := map[string]*Query{
+		"no query":       Or(),
+		"kinds":          Or(NewQuery(nil, "User"), NewQuery(nil, "Org")),
+		"limit":          Or(NewQuery(nil, "User").Limit(1)),
+		"order":          Or(NewQuery(nil, "User").Order("Name")),
+		"invalid filter": Or(NewQuery(nil, "User").Filter("Name ~", 1)),
+	}
+	for name, q := range tests {
+		if q.err == nil {
+			t.Errorf("%s: Or should fail", name)
+		}
+	}
+
+	if _, _, err := NewQuery(nil, "User").FilterIn("A", 1, 2).Start(Cursor{cursorStr: "c"}).compile(nil); err != errMergedCursor {
+		t.Errorf("compile with a cursor returned %v, want %v", err, errMergedCursor)
+	}
+}
+
+func TestCompareRows(t *testing.T) {
+	key := func(id int64) *datastore.Key {
+		return ConvertKeyToDsKey(nil, &Key{kind: "User", intID: id, appID: "app"})
+	}
+	row := func(id int64, values ...interface{}) queryRow {
+		r := queryRow{key: key(id)}
+		for _, v := range values {
+			r.props = append(r.props, datastore.Property{Name: "A", Value: v, Multiple: len(values) > 1})
+		}
+		return r
+	}
+
+	tests := []struct {
+		order string
+		less  queryRow
+		more  queryRow
+	}{
+		// without orders the rows are sorted by key
+		{"", row(1), row(2)},
+		{"A", row(2, int64(1)), row(1, int64(2))},
+		{"-A", row(1, int64(2)), row(2, int64(1))},
+		// a multi-valued property sorts by its lowest value ascending and by
+		// its highest one descending
+		{"A", row(1, int64(7), int64(1)), row(2, int64(5))},
+		{"-A", row(1, int64(7), int64(1)), row(2, int64(5))},
+		// values of different types sort by type: integers before strings
+		{"A", row(2, int64(9)), row(1, "a")},
+		// equal values fall back to the key
+		{"A", row(1, "a"), row(2, "a")},
+	}
+
+	for _, test := range tests {
+		q := NewQuery(nil, "User")
+		if test.order != "" {
+			q = q.Order(test.order)
+		}
+		if c := q.compareRows(test.less, test.more); c >= 0 {
+			t.Errorf("order %q: compareRows(%v, %v) = %d, want < 0", test.order, test.less.props, test.more.props, c)
+		}
+		if c := q.compareRows(test.more, test.less); c <= 0 {
+			t.Errorf("order %q: compareRows(%v, %v) = %d, want > 0", test.order, test.more.props, test.less.props, c)
+		}
+	}
+}
+
+func TestMergeRows(t *testing.T) {
+	key := func(id int64) *datastore.Key {
+		return ConvertKeyToDsKey(nil, &Key{kind: "User", intID: id, appID: "app"})
+	}
+	row := func(id int64, tag string) queryRow {
+		return queryRow{key: key(id), props: datastore.PropertyList{{Name: "Tag", Value: tag}}}
+	}
+	// the rows of two branches, both finding the tags of the same entities
+	results := [][]queryRow{
+		{row(1, "a"), row(1, "b"), row(2, "a")},
+		{row(1, "a"), row(2, "a"), row(2, "c")},
+	}
+
+	tests := []struct {
+		name string
+		q    *Query
+		want []queryRow
+	}{
+		{"entities", NewQuery(nil, "User"), []queryRow{row(1, "a"), row(2, "a")}},
+		{"projection", NewQuery(nil, "User").Project("Tag"), []queryRow{row(1, "a"), row(1, "b"), row(2, "a"), row(2, "c")}},
+		{"distinct", NewQuery(nil, "User").Project("Tag").Distinct().Order("Tag"), []queryRow{row(1, "a"), row(1, "b"), row(2, "c")}},
+	}
+
+	for _, test := range tests {
+		got := test.q.mergeRows(results)
+		if len(got) != len(test.want) {
+			t.Errorf("%s: merged %d rows, want %d", test.name, len(got), len(test.want))
+			continue
+		}
+		for i := range got {
+			if !got[i].key.Equal(test.want[i].key) || !reflect.DeepEqual(got[i].props, test.want[i].props) {
+				t.Errorf("%s: row %d is %v %v, want %v %v", test.name, i,
+					got[i].key, got[i].props, test.want[i].key, test.want[i].props)
+			}
+		}
+	}
+}
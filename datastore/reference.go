@@ -0,0 +1,249 @@
+package datastore
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"google.golang.org/appengine/datastore"
+	"strings"
+)
+
+// Keys are encoded offline as the Reference protobuf used by the SDK, so the
+// result is the same web-safe string datastore.Key.Encode gives and no App
+// Engine context is needed, which keeps mock keys encodable.
+//
+//	message Reference {
+//	  required string app = 13;
+//	  optional string name_space = 20;
+//	  required Path path = 14;
+//	}
+//	message Path {
+//	  repeated group Element = 1 {
+//	    required string type = 2;
+//	    optional int64 id = 3;
+//	    optional string name = 4;
+//	  }
+//	}
+
+const (
+	wireVarint     = 0
+	wireFixed64    = 1
+	wireBytes      = 2
+	wireStartGroup = 3
+	wireEndGroup   = 4
+	wireFixed32    = 5
+
+	fieldApp       = 13
+	fieldPath      = 14
+	fieldNamespace = 20
+
+	fieldElement = 1
+	fieldType    = 2
+	fieldID      = 3
+	fieldName    = 4
+)
+
+var errBadReference = errors.New("datastore: malformed key reference")
+
+// appendUvarint appends the varint of v, binary.AppendUvarint being too
+// recent for the Go versions the package builds with.
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+func appendTag(b []byte, field int, wire int) []byte {
+	return appendUvarint(b, uint64(field<<3|wire))
+}
+
+func appendBytes(b []byte, field int, v []byte) []byte {
+	b = appendTag(b, field, wireBytes)
+	b = appendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// encodeKey returns the web-safe Reference encoding of k.
+func encodeKey(k *Key) string {
+	var chain []*Key
+	for i := k; i != nil; i = i.parent {
+		chain = append([]*Key{i}, chain...)
+	}
+
+	var path []byte
+	for _, i := range chain {
+		path = appendTag(path, fieldElement, wireStartGroup)
+		path = appendBytes(path, fieldType, []byte(i.kind))
+		// at most one of id and name is set, neither for incomplete keys
+		if i.stringID != "" {
+			path = appendBytes(path, fieldName, []byte(i.stringID))
+		} else if i.intID != 0 {
+			path = appendTag(path, fieldID, wireVarint)
+			path = appendUvarint(path, uint64(i.intID))
+		}
+		path = appendTag(path, fieldElement, wireEndGroup)
+	}
+
+	b := appendBytes(nil, fieldApp, []byte(k.appID))
+	b = appendBytes(b, fieldPath, path)
+	if k.namespace != "" {
+		b = appendBytes(b, fieldNamespace, []byte(k.namespace))
+	}
+
+	// Trailing padding is stripped.
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeKey decodes a key encoded by encodeKey or datastore.Key.Encode.
+// Unlike the SDK it accepts an empty app, as mock keys have none.
+func decodeKey(encoded string) (*Key, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		appID, namespace string
+		path             []byte
+	)
+	r := &reader{b: b}
+	for !r.done() {
+		field, wire := r.tag()
+		switch {
+		case field == fieldApp && wire == wireBytes:
+			appID = string(r.bytes())
+		case field == fieldNamespace && wire == wireBytes:
+			namespace = string(r.bytes())
+		case field == fieldPath && wire == wireBytes:
+			path = r.bytes()
+		default:
+			r.skip(field, wire)
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	var k *Key
+	r = &reader{b: path}
+	for !r.done() {
+		field, wire := r.tag()
+		if field != fieldElement || wire != wireStartGroup {
+			r.skip(field, wire)
+			continue
+		}
+
+		k = &Key{
+			parent:    k,
+			appID:     appID,
+			namespace: namespace,
+		}
+		closed := false
+		for !r.done() {
+			field, wire = r.tag()
+			if field == fieldElement && wire == wireEndGroup {
+				closed = true
+				break
+			}
+			switch {
+			case field == fieldType && wire == wireBytes:
+				k.kind = string(r.bytes())
+			case field == fieldID && wire == wireVarint:
+				k.intID = int64(r.varint())
+			case field == fieldName && wire == wireBytes:
+				k.stringID = string(r.bytes())
+			default:
+				r.skip(field, wire)
+			}
+		}
+		if !closed {
+			r.fail()
+			break
+		}
+
+		if k.kind == "" || (k.stringID != "" && k.intID != 0) || (k.parent != nil && k.parent.Incomplete()) {
+			return nil, datastore.ErrInvalidKey
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	if k == nil {
+		return nil, datastore.ErrInvalidKey
+	}
+	return k, nil
+}
+
+// reader reads protobuf wire data, remembering the first error.
+type reader struct {
+	b   []byte
+	err error
+}
+
+func (r *reader) done() bool {
+	return r.err != nil || len(r.b) == 0
+}
+
+func (r *reader) varint() uint64 {
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *reader) tag() (field int, wire int) {
+	v := r.varint()
+	return int(v >> 3), int(v & 7)
+}
+
+func (r *reader) bytes() []byte {
+	n := r.varint()
+	if r.err != nil || n > uint64(len(r.b)) {
+		r.fail()
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *reader) skip(field int, wire int) {
+	switch wire {
+	case wireVarint:
+		r.varint()
+	case wireBytes:
+		r.bytes()
+	case wireFixed64, wireFixed32:
+		n := 8
+		if wire == wireFixed32 {
+			n = 4
+		}
+		if len(r.b) < n {
+			r.fail()
+			return
+		}
+		r.b = r.b[n:]
+	case wireStartGroup:
+		for !r.done() {
+			f, w := r.tag()
+			if f == field && w == wireEndGroup {
+				return
+			}
+			r.skip(f, w)
+		}
+		r.fail()
+	default:
+		r.fail()
+	}
+}
+
+func (r *reader) fail() {
+	if r.err == nil {
+		r.err = errBadReference
+	}
+	r.b = nil
+}
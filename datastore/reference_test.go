@@ -0,0 +1,89 @@
+package datastore
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"testing"
+)
+
+// sdkKey builds the SDK key of path, alternating kinds and IDs from the
+// root, in namespace. The SDK takes the appID from GAE_APPLICATION when the
+// context is not an App Engine one.
+func sdkKey(t *testing.T, namespace string, path ...interface{}) *datastore.Key {
+	ctx, err := appengine.Namespace(context.Background(), namespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var k *datastore.Key
+	for i := 0; i < len(path); i += 2 {
+		switch id := path[i+1].(type) {
+		case string:
+			k = datastore.NewKey(ctx, path[i].(string), id, 0, k)
+		case int:
+			k = datastore.NewKey(ctx, path[i].(string), "", int64(id), k)
+		}
+	}
+	return k
+}
+
+func TestEncodeKeyMatchesSDK(t *testing.T) {
+	t.Setenv("GAE_APPLICATION", "s~test-app")
+
+	tests := []struct {
+		name      string
+		namespace string
+		path      []interface{}
+	}{
+		{"string ID", "", []interface{}{"User", "alice"}},
+		{"int ID", "", []interface{}{"User", 42}},
+		{"negative ID", "", []interface{}{"User", -5}},
+		{"large ID", "", []interface{}{"User", 1 << 62}},
+		{"incomplete", "", []interface{}{"User", 0}},
+		{"parent", "", []interface{}{"Org", "acme", "User", 42}},
+		{"incomplete with parent", "", []interface{}{"Org", "acme", "User", 0}},
+		{"namespace", "tenant", []interface{}{"User", "alice"}},
+		{"parent and namespace", "tenant", []interface{}{"Org", 7, "Team", "core", "User", -1}},
+	}
+
+	for _, test := range tests {
+		dsKey := sdkKey(t, test.namespace, test.path...)
+		key := ConvertDsKeyToKey(dsKey)
+		// encode from the fields, not from the SDK key kept by the conversion
+		key.dsKey = nil
+		for p := key.parent; p != nil; p = p.parent {
+			p.dsKey = nil
+		}
+
+		want := dsKey.Encode()
+		if got := encodeKey(key); got != want {
+			t.Errorf("%s: encodeKey = %s, want %s", test.name, got, want)
+		}
+
+		decoded, err := decodeKey(want)
+		if err != nil {
+			t.Errorf("%s: decodeKey(%s): %v", test.name, want, err)
+			continue
+		}
+		if !decoded.Equal(key) || decoded.appID != dsKey.AppID() || decoded.namespace != dsKey.Namespace() {
+			t.Errorf("%s: decodeKey(%s) = %s in %q, want %s in %q", test.name, want,
+				decoded.Path(), decoded.namespace, key.Path(), key.namespace)
+		}
+	}
+}
+
+func TestDecodeKeyMalformed(t *testing.T) {
+	for _, encoded := range []string{
+		"",
+		"not base64!",
+		// a path element group which is never closed
+		"agNhcHByBQsSAUE",
+		// a key without a path
+		"agNhcHA",
+	} {
+		if k, err := decodeKey(encoded); err == nil {
+			t.Errorf("decodeKey(%q) = %v, want an error", encoded, k.Path())
+		}
+	}
+}
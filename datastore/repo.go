@@ -0,0 +1,202 @@
+//go:build go1.18
+
+package datastore
+
+import (
+	"fmt"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"reflect"
+)
+
+// Repo stores the entities of a kind as structs of type T, which has a
+// Key *Key field tagged datastore:"-" so that it isn't saved as a property.
+// The key of an entity is taken from that field when it is saved and written
+// back to it when the entity is saved or loaded.
+//
+// The methods of a Repo take untyped keys, pass TypedKey[T].Key for a typed
+// key. A Repo goes through Get, Put, NewQuery and the other functions of this
+// package, so it is mocked with DatastoreMock and MockQuery like any other
+// code.
+type Repo[T any] struct {
+	kind string
+	// keyIndex is the index of the Key field in T
+	keyIndex []int
+	err      error
+}
+
+// NewRepo returns the repository of kind. A T without an unsaved Key *Key
+// field is reported by every method of the repository.
+func NewRepo[T any](kind string) *Repo[T] {
+	r := &Repo[T]{kind: kind}
+
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	if t.Kind() != reflect.Struct {
+		r.err = fmt.Errorf("datastore: repository of %s should hold structs, not %v", kind, t)
+		return r
+	}
+	f, ok := t.FieldByName("Key")
+	if !ok || f.Type != typeOfKey {
+		r.err = fmt.Errorf("datastore: %v should have a Key *Key field", t)
+		return r
+	}
+	// the key would otherwise be saved as a property of its own entity
+	if f.Tag.Get("datastore") != "-" {
+		r.err = fmt.Errorf(`datastore: the Key field of %v should be tagged datastore:"-"`, t)
+		return r
+	}
+	r.keyIndex = f.Index
+	return r
+}
+
+// Kind returns the kind of the entities of the repository.
+func (r *Repo[T]) Kind() string {
+	return r.kind
+}
+
+func (r *Repo[T]) key(v *T) *Key {
+	return reflect.ValueOf(v).Elem().FieldByIndex(r.keyIndex).Interface().(*Key)
+}
+
+func (r *Repo[T]) setKey(v *T, key *Key) {
+	reflect.ValueOf(v).Elem().FieldByIndex(r.keyIndex).Set(reflect.ValueOf(key))
+}
+
+// Get loads the entity stored for key and sets its Key field.
+func (r *Repo[T]) Get(ctx context.Context, key *Key) (*T, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	v, err := GetAs[*T](ctx, key)
+	if err != nil {
+		if _, ok := err.(*datastore.ErrFieldMismatch); !ok {
+			return nil, err
+		}
+	}
+	r.setKey(v, key)
+	return v, err
+}
+
+// GetMulti is a batch version of Get. Per-key failures are reported as an
+// appengine.MultiError and only the entities that were loaded have their Key
+// field set.
+func (r *Repo[T]) GetMulti(ctx context.Context, keys []*Key) ([]*T, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	values, err := GetMultiAs[*T](ctx, keys)
+	errs, isMulti := err.(appengine.MultiError)
+	if err != nil && !isMulti {
+		return nil, err
+	}
+	for i, v := range values {
+		if !isMulti || errs[i] == nil {
+			r.setKey(v, keys[i])
+		}
+	}
+	return values, err
+}
+
+// Put saves v under its Key field and writes the complete key back to it.
+// An entity without a key gets an incomplete key of the repository's kind,
+// which under a mock context consumes an ExpectKey expectation.
+func (r *Repo[T]) Put(ctx context.Context, v *T) (*Key, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	key := r.key(v)
+	if key == nil {
+		key = NewKey(ctx, r.kind, "", 0, nil)
+	}
+
+	key, err := Put(ctx, key, v)
+	if err != nil {
+		return nil, err
+	}
+	r.setKey(v, key)
+	return key, nil
+}
+
+// PutMulti is a batch version of Put.
+func (r *Repo[T]) PutMulti(ctx context.Context, values []*T) ([]*Key, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	keys := make([]*Key, len(values))
+	for i, v := range values {
+		keys[i] = r.key(v)
+		if keys[i] == nil {
+			keys[i] = NewKey(ctx, r.kind, "", 0, nil)
+		}
+	}
+
+	keys, err := PutMulti(ctx, keys, values)
+	if err != nil {
+		return nil, err
+	}
+	for i, v := range values {
+		r.setKey(v, keys[i])
+	}
+	return keys, nil
+}
+
+// Delete deletes the entity stored for key.
+func (r *Repo[T]) Delete(ctx context.Context, key *Key) error {
+	if r.err != nil {
+		return r.err
+	}
+	return Delete(ctx, key)
+}
+
+// NewQuery returns a query for the entities of the repository.
+func (r *Repo[T]) NewQuery(ctx context.Context) *Query {
+	return NewQuery(ctx, r.kind)
+}
+
+// Query runs q and returns its entities with their Key field set. A nil q
+// returns every entity of the repository.
+func (r *Repo[T]) Query(ctx context.Context, q *Query) ([]*T, error) {
+	q, err := r.query(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	values, keys, err := GetAllAs[*T](ctx, q)
+	if err != nil {
+		if _, ok := err.(*datastore.ErrFieldMismatch); !ok {
+			return nil, err
+		}
+	}
+	for i, v := range values {
+		r.setKey(v, keys[i])
+	}
+	return values, err
+}
+
+// Count returns the number of entities matched by q, or of all the entities
+// of the repository for a nil q.
+func (r *Repo[T]) Count(ctx context.Context, q *Query) (int, error) {
+	q, err := r.query(ctx, q)
+	if err != nil {
+		return 0, err
+	}
+	return q.Count(ctx)
+}
+
+func (r *Repo[T]) query(ctx context.Context, q *Query) (*Query, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	if q == nil {
+		return r.NewQuery(ctx), nil
+	}
+	if q.kind != r.kind {
+		return nil, fmt.Errorf("datastore: query of kind %s run by the repository of %s", q.kind, r.kind)
+	}
+	return q, nil
+}
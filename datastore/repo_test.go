@@ -0,0 +1,63 @@
+//go:build go1.18
+
+package datastore
+
+import (
+	gaemock "github.com/ahmadmuzakki/gae/mock"
+	"google.golang.org/appengine/datastore"
+	"strings"
+	"testing"
+)
+
+type repoUser struct {
+	Key  *Key `datastore:"-"`
+	Name string
+}
+
+func TestNewRepoKeyField(t *testing.T) {
+	type untagged struct {
+		Key  *Key
+		Name string
+	}
+	type noKey struct {
+		Name string
+	}
+
+	if err := NewRepo[untagged]("User").err; err == nil || !strings.Contains(err.Error(), `datastore:"-"`) {
+		t.Errorf("NewRepo with an untagged Key field returned %v", err)
+	}
+	if err := NewRepo[noKey]("User").err; err == nil {
+		t.Error("NewRepo without a Key field should fail")
+	}
+	if err := NewRepo[repoUser]("User").err; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRepoPutDoesNotSaveKey(t *testing.T) {
+	ctx, dm := NewMock(gaemock.NewMock())
+	incomplete := dm.ExpectKey(ctx, "User", "", 0, nil)
+	complete := dm.ExpectKey(ctx, "User", "", 5, nil)
+	repo := NewRepo[repoUser]("User")
+
+	u := &repoUser{Name: "alice"}
+	dm.MockPut(incomplete, &repoUser{Name: "alice"}).WillReturnKeyErr(complete, nil)
+	key, err := repo.Put(ctx, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != complete || u.Key != complete {
+		t.Errorf("Put returned %v and set %v, want %v", key, u.Key, complete)
+	}
+
+	// the SDK saves the struct itself as its Key field is skipped
+	props, err := datastore.SaveStruct(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range props {
+		if p.Name == "Key" {
+			t.Errorf("the Key field is saved as %v", p)
+		}
+	}
+}
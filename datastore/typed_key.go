@@ -0,0 +1,149 @@
+//go:build go1.18
+
+package datastore
+
+import (
+	"bytes"
+	"fmt"
+	"golang.org/x/net/context"
+	"reflect"
+	"sync"
+)
+
+var (
+	kindsMutex sync.Mutex
+	kinds      = make(map[reflect.Type]string)
+)
+
+// RegisterKind sets the kind of the entities of type T, which is the kind of
+// their TypedKey. It is usually called from an init function.
+func RegisterKind[T any](kind string) {
+	if kind == "" {
+		panic("datastore: RegisterKind with an empty kind")
+	}
+
+	kindsMutex.Lock()
+	defer kindsMutex.Unlock()
+	kinds[reflect.TypeOf((*T)(nil)).Elem()] = kind
+}
+
+// KindOf returns the kind registered for T, which defaults to the name of the
+// type. It panics for an unnamed type, such as a pointer, that isn't
+// registered, as it has no kind.
+func KindOf[T any]() string {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+
+	kindsMutex.Lock()
+	kind, ok := kinds[t]
+	kindsMutex.Unlock()
+	if ok {
+		return kind
+	}
+	if t.Name() == "" {
+		panic(fmt.Sprintf("datastore: no kind registered for the unnamed type %v", t))
+	}
+	return t.Name()
+}
+
+// TypedKey is the key of an entity of type T, whose kind is KindOf[T]. T is
+// the struct type of the entity, not a pointer to it. The key helpers taking
+// a TypedKey[T], like GetAs[T], only accept the key of a T, so mixing up keys
+// of different kinds is a compile error. The zero TypedKey is the nil key.
+//
+// A TypedKey field is saved as a key property, and a TypedKey is encoded in
+// JSON like a *Key.
+type TypedKey[T any] struct {
+	key *Key
+}
+
+// NewTypedKey creates a key of kind KindOf[T], see NewKey.
+func NewTypedKey[T any](ctx context.Context, stringID string, intID int64, parent *Key) TypedKey[T] {
+	return TypedKey[T]{key: NewKey(ctx, KindOf[T](), stringID, intID, parent)}
+}
+
+// TypedKeyOf converts key to the key of a T, failing when key is of another
+// kind.
+func TypedKeyOf[T any](key *Key) (TypedKey[T], error) {
+	if key != nil && key.kind != KindOf[T]() {
+		return TypedKey[T]{}, fmt.Errorf("datastore: key of kind %s is not a key of %s", key.kind, KindOf[T]())
+	}
+	return TypedKey[T]{key: key}, nil
+}
+
+// Key returns the untyped key.
+func (k TypedKey[T]) Key() *Key {
+	return k.key
+}
+
+// IsZero returns whether k is the nil key.
+func (k TypedKey[T]) IsZero() bool {
+	return k.key == nil
+}
+
+// Equal returns whether two keys are equal.
+func (k TypedKey[T]) Equal(o TypedKey[T]) bool {
+	if k.key == nil || o.key == nil {
+		return k.key == o.key
+	}
+	return k.key.Equal(o.key)
+}
+
+func (k TypedKey[T]) String() string {
+	if k.key == nil {
+		return ""
+	}
+	return k.key.String()
+}
+
+func (k TypedKey[T]) untyped() *Key {
+	return k.key
+}
+
+func (k *TypedKey[T]) setUntyped(key *Key) {
+	k.key = key
+}
+
+func (k TypedKey[T]) MarshalJSON() ([]byte, error) {
+	if k.key == nil {
+		return []byte("null"), nil
+	}
+	return k.key.MarshalJSON()
+}
+
+func (k *TypedKey[T]) UnmarshalJSON(buf []byte) error {
+	if bytes.Equal(buf, []byte("null")) {
+		k.key = nil
+		return nil
+	}
+
+	var key Key
+	if err := key.UnmarshalJSON(buf); err != nil {
+		return err
+	}
+	typed, err := TypedKeyOf[T](&key)
+	if err != nil {
+		return err
+	}
+	*k = typed
+	return nil
+}
+
+// PutAs saves v under key and returns its complete key.
+func PutAs[T any, K interface{ *Key | TypedKey[T] }](ctx context.Context, key K, v *T) (TypedKey[T], error) {
+	k, err := Put(ctx, untypedKey[T](key), v)
+	if err != nil {
+		return TypedKey[T]{}, err
+	}
+	return TypedKey[T]{key: k}, nil
+}
+
+// untypedKey returns the *Key of a key helper argument.
+func untypedKey[T any, K interface{ *Key | TypedKey[T] }](key K) *Key {
+	switch k := interface{}(key).(type) {
+	case TypedKey[T]:
+		return k.key
+	case *Key:
+		return k
+	}
+	return nil
+}
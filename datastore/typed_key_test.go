@@ -0,0 +1,68 @@
+//go:build go1.18
+
+package datastore
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+type typedUser struct {
+	Name string
+}
+
+type typedMember struct {
+	Name string
+}
+
+func init() {
+	RegisterKind[typedMember]("Member")
+}
+
+func TestKindOf(t *testing.T) {
+	if kind := KindOf[typedUser](); kind != "typedUser" {
+		t.Errorf("KindOf[typedUser] = %q, want the type name", kind)
+	}
+	if kind := KindOf[typedMember](); kind != "Member" {
+		t.Errorf("KindOf[typedMember] = %q, want the registered kind", kind)
+	}
+}
+
+func TestKindOfUnnamed(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("KindOf[*typedUser] should panic")
+		}
+	}()
+	KindOf[*typedUser]()
+}
+
+func TestTypedKeyOf(t *testing.T) {
+	if _, err := TypedKeyOf[typedMember](&Key{kind: "User", intID: 1, appID: "app"}); err == nil {
+		t.Error("TypedKeyOf should fail for a key of another kind")
+	}
+
+	key := &Key{kind: "Member", intID: 1, appID: "app"}
+	tk, err := TypedKeyOf[typedMember](key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tk.Key() != key {
+		t.Errorf("TypedKeyOf returned %v, want %v", tk.Key(), key)
+	}
+}
+
+func TestTypedKeyJSON(t *testing.T) {
+	tk := TypedKey[typedMember]{key: &Key{kind: "Member", intID: 1, appID: "app"}}
+	if err := json.Unmarshal([]byte("null"), &tk); err != nil || !tk.IsZero() {
+		t.Fatalf("unmarshal null = %v, %v, want the nil key", tk, err)
+	}
+
+	buf, err := json.Marshal(TypedKey[typedUser]{key: &Key{kind: "User", intID: 1, appID: "app"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(buf, &tk); err == nil {
+		t.Error("unmarshal of a key of another kind should fail")
+	}
+}